@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/data_lock"
+	"github.com/jameycribbs/pythia/models"
+	"os"
+)
+
+// actorLogin is who the audit log says made changes from the command line.
+const actorLogin = "command line"
+
+// collection is one directory under the data directory and the type of
+// record kept in it.
+type collection struct {
+	name   string
+	newRec func() interface{}
+}
+
+var collections = []collection{
+	{"answers", func() interface{} { return &models.Answer{} }},
+	{"users", func() interface{} { return &models.User{} }},
+	{"password_resets", func() interface{} { return &models.PasswordReset{} }},
+	{"sessions", func() interface{} { return &models.Session{} }},
+	{"api_tokens", func() interface{} { return &models.ApiToken{} }},
+	{"audit", func() interface{} { return &models.AuditEntry{} }},
+	{"questions", func() interface{} { return &models.Question{} }},
+	{"comments", func() interface{} { return &models.Comment{} }},
+	{"editions", func() interface{} { return &models.Edition{} }},
+	{"webhooks", func() interface{} { return &models.Webhook{} }},
+	{"webhook_deliveries", func() interface{} { return &models.WebhookDelivery{} }},
+}
+
+var commands = map[string]func(flags *flag.FlagSet, dataDir *string, args []string) error{
+	"user":    user,
+	"reindex": reindex,
+	"backup":  backup,
+	"restore": restore,
+	"export":  export,
+	"import":  importAnswers,
+	"fsck":    fsck,
+}
+
+// IsCommand reports whether name is one of the admin commands.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+
+	return ok
+}
+
+// Run runs the admin command name with the rest of the command line.  Each
+// command defines its own flags on top of -data.
+func Run(name string, args []string) error {
+	run, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %v", name)
+	}
+
+	flags := flag.NewFlagSet("pythia "+name, flag.ExitOnError)
+	dataDir := flags.String("data", "data", "data directory")
+
+	return run(flags, dataDir, args)
+}
+
+// Collections lists every collection kept in the data directory.
+func Collections() []string {
+	var names []string
+
+	for _, c := range collections {
+		names = append(names, c.name)
+	}
+
+	return names
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func openDB(dataDir string) (*ivy.DB, error) {
+	_, err := os.Stat(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return ivy.OpenDB(dataDir, models.FieldsToIndex())
+}
+
+// openDBForWriting is openDB for the commands that change the data
+// directory.  It refuses while the server, or another command, is using it;
+// close the database with the function it returns.
+func openDBForWriting(dataDir string) (*ivy.DB, func(), error) {
+	db, err := openDB(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, func() { db.Close(); lock.Release() }, nil
+}
+
+func lockDataDir(dataDir string) (*data_lock.Lock, error) {
+	lock, err := data_lock.Acquire(dataDir)
+	if errors.Is(err, data_lock.ErrLocked) {
+		return nil, fmt.Errorf("%v; stop the server before running commands that change it", err)
+	}
+
+	return lock, err
+}
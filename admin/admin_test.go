@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"flag"
+	"github.com/jameycribbs/pythia/data_lock"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritingRefusedWhileServerRuns(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, c := range collections {
+		err := os.Mkdir(filepath.Join(dir, c.name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock, err := data_lock.Acquire(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reindex(flag.NewFlagSet("reindex", flag.ContinueOnError), &dir, nil)
+	if err == nil || !strings.Contains(err.Error(), "stop the server") {
+		t.Errorf("reindex while locked: got %v", err)
+	}
+
+	db, err := openDB(dir)
+	if err != nil {
+		t.Fatalf("reading while locked: %v", err)
+	}
+	db.Close()
+
+	lock.Release()
+
+	err = reindex(flag.NewFlagSet("reindex", flag.ContinueOnError), &dir, nil)
+	if err != nil {
+		t.Errorf("reindex once unlocked: %v", err)
+	}
+}
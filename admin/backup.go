@@ -0,0 +1,219 @@
+package admin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/pythia/data_lock"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backup writes the whole data directory to a gzipped tar file.  Records are
+// plain files, so a backup taken while the server is running is consistent
+// file by file, though a change being made at that moment may be half in it.
+func backup(flags *flag.FlagSet, dataDir *string, args []string) error {
+	output := flags.String("o", "pythia-backup-"+time.Now().Format("20060102-150405")+".tar.gz", "file to write")
+	flags.Parse(args)
+
+	_, err := os.Stat(*dataDir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	count := 0
+
+	err = filepath.Walk(*dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(*dataDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if (!info.IsDir() && !info.Mode().IsRegular()) || rel == data_lock.FileName {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		count++
+
+		return err
+	})
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+
+	if err != nil {
+		os.Remove(*output)
+		return err
+	}
+
+	fmt.Printf("Backed up %v files to %v.\n", count, *output)
+
+	return nil
+}
+
+// restore unpacks a backup into the data directory.  It refuses to write over
+// a data directory that already has something in it unless given -force.
+func restore(flags *flag.FlagSet, dataDir *string, args []string) error {
+	force := flags.Bool("force", false, "restore into a data directory that is not empty")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: pythia restore [-data dir] [-force] <backup.tar.gz>")
+	}
+
+	entries, err := os.ReadDir(*dataDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if len(entries) == 1 && entries[0].Name() == data_lock.FileName {
+		entries = nil
+	}
+
+	if len(entries) > 0 && !*force {
+		return fmt.Errorf("%v is not empty; stop the server and use -force to restore over it", *dataDir)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+
+	err = os.MkdirAll(*dataDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockDataDir(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	count := 0
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok := cleanEntryName(hdr.Name)
+		if !ok {
+			return fmt.Errorf("refusing to restore %q from outside the data directory", hdr.Name)
+		}
+
+		target := filepath.Join(*dataDir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = restoreFile(tr, target)
+			count++
+		default:
+			fmt.Printf("Skipping %v, which is not a regular file.\n", hdr.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Restored %v files into %v.\n", count, *dataDir)
+
+	return nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func restoreFile(r io.Reader, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// cleanEntryName turns a tar entry name into a relative path, rejecting any
+// that would land outside the directory being restored into.
+func cleanEntryName(name string) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+
+	return filepath.FromSlash(name), true
+}
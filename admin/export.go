@@ -0,0 +1,273 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/models"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Export is the file written by "pythia export" and read by "pythia import".
+// Ids are those of the exporting site; import gives everything new ones.
+type Export struct {
+	ExportedAt time.Time         `json:"exportedat"`
+	Editions   []ExportedEdition `json:"editions"`
+	Answers    []ExportedAnswer  `json:"answers"`
+}
+
+type ExportedEdition struct {
+	Id string `json:"id"`
+	*models.Edition
+}
+
+type ExportedAnswer struct {
+	Id string `json:"id"`
+	*models.Answer
+}
+
+// export writes every edition and every answer not in the trash as JSON.
+func export(flags *flag.FlagSet, dataDir *string, args []string) error {
+	output := flags.String("o", "", "file to write (defaults to standard output)")
+	flags.Parse(args)
+
+	db, err := openDB(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	data := Export{ExportedAt: time.Now(), Editions: []ExportedEdition{}, Answers: []ExportedAnswer{}}
+
+	editions, err := models.AllEditions(db)
+	if err != nil {
+		return err
+	}
+
+	for _, edition := range editions {
+		data.Editions = append(data.Editions, ExportedEdition{edition.FileId, edition})
+	}
+
+	ids, err := db.FindAllIds("answers")
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		err = db.Find("answers", &answer, id)
+		if err != nil {
+			return err
+		}
+
+		if !answer.IsDeleted() {
+			data.Answers = append(data.Answers, ExportedAnswer{id, &answer})
+		}
+	}
+
+	var w io.Writer = os.Stdout
+
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	err = enc.Encode(data)
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		fmt.Printf("Exported %v answers and %v editions to %v.\n", len(data.Answers), len(data.Editions), *output)
+	}
+
+	return nil
+}
+
+// importAnswers adds the answers in an export to this site as new records
+// created by the -as user.  Editions are matched to existing ones by name and
+// created when missing.  Answers whose question is already here word for word
+// are skipped, so running the same import twice doesn't duplicate anything.
+func importAnswers(flags *flag.FlagSet, dataDir *string, args []string) error {
+	login := flags.String("as", "", "login of the user the answers are created by (required)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *login == "" {
+		return errors.New("usage: pythia import [-data dir] -as <login> <export.json>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var data Export
+
+	err = json.NewDecoder(f).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("could not read %v: %v", flags.Arg(0), err)
+	}
+
+	db, closeDB, err := openDBForWriting(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	user, err := findUser(db, *login)
+	if err != nil {
+		return err
+	}
+
+	editionIds, created, err := importEditions(db, user, data.Editions)
+	if err != nil {
+		return err
+	}
+
+	existing, err := existingQuestions(db)
+	if err != nil {
+		return err
+	}
+
+	imported, skipped := 0, 0
+
+	for _, exported := range data.Answers {
+		if exported.Answer == nil {
+			continue
+		}
+
+		key := questionKey(exported.Question)
+
+		if existing[key] {
+			skipped++
+			continue
+		}
+
+		now := time.Now()
+
+		rec := *exported.Answer
+		rec.CreatedById = user.FileId
+		rec.UpdatedById = user.FileId
+		rec.CreatedAt = now
+		rec.UpdatedAt = now
+		rec.ReviewedById = ""
+		rec.VerifiedById = ""
+		rec.Trash = models.Trash{}
+
+		rec.Editions = nil
+		for _, id := range exported.Editions {
+			if newId, ok := editionIds[id]; ok {
+				rec.Editions = append(rec.Editions, newId)
+			}
+		}
+
+		if rec.Status == "" {
+			rec.Status = models.StatusPublished
+		}
+
+		fileId, err := db.Create("answers", rec)
+		if err != nil {
+			return err
+		}
+
+		audit.Record(db, nil, audit.Event{Actor: user, Action: "create", Collection: "answers", TargetId: fileId,
+			Detail: "import", After: rec})
+
+		existing[key] = true
+		imported++
+	}
+
+	fmt.Printf("Imported %v answers (%v already here) and created %v editions.\n", imported, skipped, created)
+
+	return nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// importEditions returns a map from the exporting site's edition ids to ours.
+func importEditions(db *ivy.DB, user *models.User, exported []ExportedEdition) (map[string]string, int, error) {
+	ids := make(map[string]string)
+	created := 0
+
+	editions, err := models.AllEditions(db)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	byName := make(map[string]string)
+	for _, edition := range editions {
+		byName[strings.ToLower(edition.Name)] = edition.FileId
+	}
+
+	for _, e := range exported {
+		if e.Edition == nil {
+			continue
+		}
+
+		if id, ok := byName[strings.ToLower(e.Name)]; ok {
+			ids[e.Id] = id
+			continue
+		}
+
+		rec := models.Edition{Name: e.Name, ReleasedAt: e.ReleasedAt, ChangedRules: e.ChangedRules,
+			CreatedById: user.FileId, CreatedAt: time.Now()}
+
+		fileId, err := db.Create("editions", rec)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		audit.Record(db, nil, audit.Event{Actor: user, Action: "create", Collection: "editions", TargetId: fileId,
+			Detail: "import", After: rec})
+
+		ids[e.Id] = fileId
+		byName[strings.ToLower(e.Name)] = fileId
+		created++
+	}
+
+	return ids, created, nil
+}
+
+func existingQuestions(db *ivy.DB) (map[string]bool, error) {
+	questions := make(map[string]bool)
+
+	ids, err := db.FindAllIds("answers")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		err = db.Find("answers", &answer, id)
+		if err != nil {
+			return nil, err
+		}
+
+		questions[questionKey(answer.Question)] = true
+	}
+
+	return questions, nil
+}
+
+func questionKey(question string) string {
+	return strings.ToLower(strings.Join(strings.Fields(question), " "))
+}
@@ -0,0 +1,202 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fsck reads every record in the data directory and reports those that can't
+// be read, that point at records which don't exist, or that break the rules
+// the web site enforces.  It changes nothing.
+func fsck(flags *flag.FlagSet, dataDir *string, args []string) error {
+	flags.Parse(args)
+
+	db, err := openDB(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	c := checker{records: make(map[string]map[string]interface{})}
+
+	for _, coll := range collections {
+		c.load(db, *dataDir, coll)
+	}
+
+	c.checkUsers()
+	c.checkAnswers()
+	c.checkReferences()
+
+	total := 0
+	for _, recs := range c.records {
+		total += len(recs)
+	}
+
+	fmt.Printf("Checked %v records in %v collections.\n", total, len(collections))
+
+	sort.Strings(c.problems)
+	sort.Strings(c.warnings)
+
+	for _, problem := range c.problems {
+		fmt.Println(problem)
+	}
+
+	for _, warning := range c.warnings {
+		fmt.Println("warning:", warning)
+	}
+
+	if len(c.problems) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+
+	if len(c.problems) == 1 {
+		return fmt.Errorf("found 1 problem")
+	}
+
+	return fmt.Errorf("found %v problems", len(c.problems))
+}
+
+type checker struct {
+	records  map[string]map[string]interface{}
+	problems []string
+	warnings []string
+}
+
+func (c *checker) problem(collection string, id string, format string, a ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf("%v/%v: ", collection, id)+fmt.Sprintf(format, a...))
+}
+
+func (c *checker) load(db *ivy.DB, dataDir string, coll collection) {
+	recs := make(map[string]interface{})
+	c.records[coll.name] = recs
+
+	_, err := os.Stat(filepath.Join(dataDir, coll.name))
+	if err != nil {
+		c.problems = append(c.problems, fmt.Sprintf("%v: missing directory", coll.name))
+		return
+	}
+
+	ids, err := db.FindAllIds(coll.name)
+	if err != nil {
+		c.problems = append(c.problems, fmt.Sprintf("%v: %v", coll.name, err))
+		return
+	}
+
+	for _, id := range ids {
+		rec := coll.newRec()
+
+		err = db.Find(coll.name, rec, id)
+		if err != nil {
+			c.problem(coll.name, id, "can't be read: %v", err)
+			continue
+		}
+
+		recs[id] = rec
+	}
+}
+
+func (c *checker) checkUsers() {
+	logins := make(map[string]string)
+
+	for id, rec := range c.records["users"] {
+		user := rec.(*models.User)
+
+		if user.Login == "" {
+			c.problem("users", id, "has no login")
+		} else if other, ok := logins[strings.ToLower(user.Login)]; ok {
+			c.problem("users", id, "has the same login as users/%v (%v)", other, user.Login)
+		} else {
+			logins[strings.ToLower(user.Login)] = id
+		}
+
+		if !validLevel(user.Level) {
+			c.problem("users", id, "has the unknown level %q", user.Level)
+		}
+
+		if len(user.Password) == 0 && user.AuthSource == "" {
+			c.problem("users", id, "has no password and no single sign-on source")
+		}
+	}
+}
+
+func (c *checker) checkAnswers() {
+	for id, rec := range c.records["answers"] {
+		answer := rec.(*models.Answer)
+
+		switch answer.Status {
+		case models.StatusDraft, models.StatusPending, models.StatusPublished, models.StatusArchived:
+		default:
+			c.problem("answers", id, "has the unknown status %q", answer.Status)
+		}
+
+		if strings.TrimSpace(answer.Question) == "" {
+			c.problem("answers", id, "has no question")
+		}
+	}
+}
+
+// checkReferences looks for ids that point at records which don't exist.
+// Pointing at a record in the trash is fine; that is what the trash is for.
+// Purging answers, comments and users from the trash leaves whatever pointed
+// at them behind, so those are only warnings.
+func (c *checker) checkReferences() {
+	for id, rec := range c.records["answers"] {
+		answer := rec.(*models.Answer)
+
+		c.purged("answers", id, "createdbyid", "users", answer.CreatedById)
+		c.purged("answers", id, "updatedbyid", "users", answer.UpdatedById)
+		c.purged("answers", id, "reviewedbyid", "users", answer.ReviewedById)
+		c.purged("answers", id, "verifiedbyid", "users", answer.VerifiedById)
+
+		for _, editionId := range answer.Editions {
+			if _, ok := c.records["editions"][editionId]; !ok {
+				c.problem("answers", id, "editions points at editions/%v, which doesn't exist", editionId)
+			}
+		}
+	}
+
+	for id, rec := range c.records["comments"] {
+		comment := rec.(*models.Comment)
+
+		c.purged("comments", id, "answerid", "answers", comment.AnswerId)
+		c.purged("comments", id, "parentid", "comments", comment.ParentId)
+		c.purged("comments", id, "createdbyid", "users", comment.CreatedById)
+	}
+
+	for id, rec := range c.records["questions"] {
+		question := rec.(*models.Question)
+
+		c.purged("questions", id, "answerid", "answers", question.AnswerId)
+		c.purged("questions", id, "handledbyid", "users", question.HandledById)
+	}
+
+	for id, rec := range c.records["sessions"] {
+		c.purged("sessions", id, "userid", "users", rec.(*models.Session).UserId)
+	}
+
+	for id, rec := range c.records["api_tokens"] {
+		c.purged("api_tokens", id, "userid", "users", rec.(*models.ApiToken).UserId)
+	}
+
+	for id, rec := range c.records["password_resets"] {
+		c.purged("password_resets", id, "userid", "users", rec.(*models.PasswordReset).UserId)
+	}
+}
+
+func (c *checker) purged(collection string, id string, field string, target string, targetId string) {
+	if targetId == "" {
+		return
+	}
+
+	if _, ok := c.records[target][targetId]; !ok {
+		c.warnings = append(c.warnings, fmt.Sprintf("%v/%v: %v points at %v/%v, which has been purged",
+			collection, id, field, target, targetId))
+	}
+}
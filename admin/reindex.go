@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/pythia/models"
+)
+
+// reindex saves every record in the indexed collections again, so that ivy
+// rewrites its index entries from what is in the files.  Use it after editing
+// or copying record files by hand.  Stop the server first.
+func reindex(flags *flag.FlagSet, dataDir *string, args []string) error {
+	flags.Parse(args)
+
+	db, closeDB, err := openDBForWriting(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	indexed := models.FieldsToIndex()
+
+	for _, coll := range collections {
+		if _, ok := indexed[coll.name]; !ok {
+			continue
+		}
+
+		ids, err := db.FindAllIds(coll.name)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			rec := coll.newRec()
+
+			err = db.Find(coll.name, rec, id)
+			if err != nil {
+				return fmt.Errorf("%v/%v: %v", coll.name, id, err)
+			}
+
+			err = db.Update(coll.name, rec, id)
+			if err != nil {
+				return fmt.Errorf("%v/%v: %v", coll.name, id, err)
+			}
+		}
+
+		fmt.Printf("Reindexed %v %v.\n", len(ids), coll.name)
+	}
+
+	return nil
+}
@@ -0,0 +1,345 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/session_store"
+	"github.com/jameycribbs/pythia/webhooks"
+	"golang.org/x/term"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var levels = []string{"contributor", "editor", "admin"}
+
+// user runs "pythia user <create|list|set-role|reset-password>".
+func user(flags *flag.FlagSet, dataDir *string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("user needs one of create, list, set-role or reset-password")
+	}
+
+	sub := args[0]
+	flags.Init("pythia user "+sub, flag.ExitOnError)
+
+	switch sub {
+	case "create":
+		return userCreate(flags, dataDir, args[1:])
+	case "list":
+		return userList(flags, dataDir, args[1:])
+	case "set-role":
+		return userSetRole(flags, dataDir, args[1:])
+	case "reset-password":
+		return userResetPassword(flags, dataDir, args[1:])
+	default:
+		return fmt.Errorf("unknown user command %v", sub)
+	}
+}
+
+func userCreate(flags *flag.FlagSet, dataDir *string, args []string) error {
+	login := flags.String("login", "", "login (required)")
+	name := flags.String("name", "", "full name")
+	email := flags.String("email", "", "email address")
+	level := flags.String("level", "contributor", "contributor, editor or admin")
+	flags.Parse(args)
+
+	if *login == "" {
+		return errors.New("-login is required")
+	}
+
+	if !validLevel(*level) {
+		return fmt.Errorf("the level must be one of %v", strings.Join(levels, ", "))
+	}
+
+	db, closeDB, err := openDBForWriting(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	taken, err := models.LoginTaken(db, *login, "")
+	if err != nil {
+		return err
+	}
+
+	if taken {
+		return fmt.Errorf("there is already a user with the login %v (perhaps in the trash)", *login)
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	rec := models.User{Name: *name, Login: *login, Email: *email, Level: *level}
+	if rec.Name == "" {
+		rec.Name = rec.Login
+	}
+
+	err = rec.SetPassword(password)
+	if err != nil {
+		return err
+	}
+
+	fileId, err := db.Create("users", rec)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(db, nil, audit.Event{ActorLogin: actorLogin, Action: "create", Collection: "users", TargetId: fileId,
+		After: rec})
+
+	// The delivery is only queued; a running server sends it the next time it
+	// looks, within a minute.
+	webhooks.New(db).Fire("user.created", fileId, rec)
+
+	fmt.Printf("Created user %v (%v) with id %v.\n", rec.Login, rec.Level, fileId)
+
+	return nil
+}
+
+func userList(flags *flag.FlagSet, dataDir *string, args []string) error {
+	asJson := flags.Bool("json", false, "print JSON instead of a table")
+	all := flags.Bool("all", false, "include users in the trash")
+	flags.Parse(args)
+
+	db, err := openDB(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ids, err := db.FindAllIds("users")
+	if err != nil {
+		return err
+	}
+
+	var users []interface{}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+
+	if !*asJson {
+		fmt.Fprintln(tw, "ID\tLOGIN\tNAME\tLEVEL\tEMAIL\t2FA\tDELETED")
+	}
+
+	for _, id := range ids {
+		rec := models.User{}
+
+		err = db.Find("users", &rec, id)
+		if err != nil {
+			return err
+		}
+
+		if rec.IsDeleted() && !*all {
+			continue
+		}
+
+		if *asJson {
+			users = append(users, struct {
+				Id string `json:"id"`
+				models.User
+			}{id, rec.AuditSnapshot().(models.User)})
+			continue
+		}
+
+		deleted := ""
+		if rec.IsDeleted() {
+			deleted = rec.DeletedAt.Format("2006-01-02")
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", id, rec.Login, rec.Name, rec.Level, rec.Email,
+			yesNo(rec.TotpEnabled), deleted)
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(users)
+	}
+
+	return tw.Flush()
+}
+
+func userSetRole(flags *flag.FlagSet, dataDir *string, args []string) error {
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: pythia user set-role <login> <level>")
+	}
+
+	login, level := flags.Arg(0), flags.Arg(1)
+
+	if !validLevel(level) {
+		return fmt.Errorf("the level must be one of %v", strings.Join(levels, ", "))
+	}
+
+	db, closeDB, err := openDBForWriting(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	rec, err := findUser(db, login)
+	if err != nil {
+		return err
+	}
+
+	before := *rec
+
+	rec.Level = level
+
+	err = db.Update("users", rec, rec.FileId)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(db, nil, audit.Event{ActorLogin: actorLogin, Action: "update", Collection: "users",
+		TargetId: rec.FileId, Detail: "level", Before: before, After: rec})
+
+	webhooks.New(db).Fire("user.updated", rec.FileId, rec)
+
+	fmt.Printf("%v is now %v (was %v).\n", login, level, before.Level)
+
+	return nil
+}
+
+// userResetPassword sets a new password and signs the user out everywhere,
+// for when an admin has locked themselves out of the web site.
+func userResetPassword(flags *flag.FlagSet, dataDir *string, args []string) error {
+	disableTwoFactor := flags.Bool("disable-2fa", false, "also turn off two-factor authentication")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: pythia user reset-password [-disable-2fa] <login>")
+	}
+
+	db, closeDB, err := openDBForWriting(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	rec, err := findUser(db, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	before := *rec
+
+	err = rec.SetPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if *disableTwoFactor {
+		rec.DisableTwoFactor()
+	}
+
+	err = db.Update("users", rec, rec.FileId)
+	if err != nil {
+		return err
+	}
+
+	err = session_store.New(db, 0, 0).RevokeUser(rec.FileId, "")
+	if err != nil {
+		return err
+	}
+
+	err = models.RevokeUserApiTokens(db, rec.FileId)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(db, nil, audit.Event{ActorLogin: actorLogin, Action: "password_reset", Collection: "users",
+		TargetId: rec.FileId, Before: before, After: rec})
+
+	fmt.Printf("The password for %v has been changed and their sessions and API tokens revoked.\n", rec.Login)
+
+	return nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func findUser(db *ivy.DB, login string) (*models.User, error) {
+	var rec models.User
+
+	id, err := db.FindFirstIdForField("users", "login", login)
+	if err != nil || id == "" {
+		return nil, fmt.Errorf("no user with the login %v", login)
+	}
+
+	err = db.Find("users", &rec, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.IsDeleted() {
+		return nil, fmt.Errorf("the user %v is in the trash", login)
+	}
+
+	return &rec, nil
+}
+
+// readPassword asks for a password twice at a terminal, or reads one line
+// from standard input when it is piped in.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no password given on standard input")
+		}
+
+		password := strings.TrimRight(line, "\r\n")
+
+		return password, models.ValidateNewPassword(password, password)
+	}
+
+	fmt.Fprint(os.Stderr, "New password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm password: ")
+	confirmation, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), models.ValidateNewPassword(string(password), string(confirmation))
+}
+
+func validLevel(level string) bool {
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+
+	return false
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_info"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Event describes one thing that happened.  ActorLogin is only needed when
+// there is no logged in Actor, e.g. the login name typed into a failed login.
+// Before and After are snapshots of the record on either side of a change.
+type Event struct {
+	Actor      *models.User
+	ActorLogin string
+	Action     string
+	Collection string
+	TargetId   string
+	Detail     string
+	Before     interface{}
+	After      interface{}
+}
+
+// Records that hold secrets (password hashes, TOTP secrets) implement
+// snapshotter to leave them out of the log.
+type snapshotter interface {
+	AuditSnapshot() interface{}
+}
+
+// Record appends an event to the audit log.  A failure to write is printed
+// rather than returned, so that a problem with the log never stops people
+// from using the site.
+func Record(db *ivy.DB, r *http.Request, event Event) {
+	entry := models.AuditEntry{ActorLogin: event.ActorLogin, Action: event.Action, Collection: event.Collection,
+		TargetId: event.TargetId, Detail: event.Detail, CreatedAt: time.Now()}
+
+	// Background jobs have no request to take an address from.
+	if r != nil {
+		entry.Ip = request_info.ClientIP(r)
+	}
+
+	if event.Actor != nil {
+		entry.ActorId = event.Actor.FileId
+		entry.ActorLogin = event.Actor.Login
+	}
+
+	entry.Before = snapshot(event.Before)
+	entry.After = snapshot(event.After)
+
+	_, err := db.Create("audit", entry)
+	if err != nil {
+		slog.Error("Could not write audit entry", "action", entry.Action, "err", err)
+	}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func snapshot(rec interface{}) json.RawMessage {
+	if rec == nil {
+		return nil
+	}
+
+	if s, ok := rec.(snapshotter); ok {
+		rec = s.AuditSnapshot()
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Could not snapshot record for audit entry", "err", err)
+		return nil
+	}
+
+	return b
+}
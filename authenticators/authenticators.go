@@ -0,0 +1,36 @@
+package authenticators
+
+import (
+	"errors"
+	"github.com/jameycribbs/pythia/models"
+)
+
+var (
+	// ErrUnknownUser means this authenticator doesn't know the login, so the
+	// next one in the chain gets a try.
+	ErrUnknownUser = errors.New("unknown login")
+
+	// ErrWrongPassword means the login is known but the password is wrong.
+	// The chain stops there.
+	ErrWrongPassword = errors.New("wrong password")
+)
+
+type Authenticator interface {
+	Authenticate(login string, password string) (*models.User, error)
+}
+
+// Chain tries each authenticator in turn until one of them knows the login.
+type Chain []Authenticator
+
+func (chain Chain) Authenticate(login string, password string) (*models.User, error) {
+	for _, a := range chain {
+		user, err := a.Authenticate(login, password)
+		if err == ErrUnknownUser {
+			continue
+		}
+
+		return user, err
+	}
+
+	return nil, ErrUnknownUser
+}
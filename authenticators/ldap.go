@@ -0,0 +1,199 @@
+package authenticators
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/webhooks"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+type LdapConfig struct {
+	Url                string
+	StartTls           bool
+	CaFile             string
+	InsecureSkipVerify bool
+
+	// The account used to look users up before binding as them.  Leave both
+	// empty to search anonymously.
+	BindDn       string
+	BindPassword string
+
+	BaseDn         string
+	UserFilter     string
+	LoginAttribute string
+	NameAttribute  string
+	EmailAttribute string
+	GroupAttribute string
+
+	// RoleMapping maps group DNs (compared case-insensitively) to levels.
+	RoleMapping map[string]string
+}
+
+// LdapConn is the part of *ldap.Conn the authenticator uses, so tests can
+// swap in an in-process stand-in through Ldap.Dial.
+type LdapConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(username string, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// Ldap authenticates with search-then-bind: it finds the user's entry with
+// the service account, then binds as that entry with the given password.
+type Ldap struct {
+	Config    LdapConfig
+	DB        *ivy.DB
+	Webhooks  *webhooks.Dispatcher
+	Dial      func(url string, tlsConfig *tls.Config) (LdapConn, error)
+	tlsConfig *tls.Config
+}
+
+func NewLdap(config LdapConfig, db *ivy.DB) (*Ldap, error) {
+	if config.Url == "" || config.BaseDn == "" {
+		return nil, errors.New("ldap url and base dn are required")
+	}
+
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+
+	if strings.Count(config.UserFilter, "%s") != 1 {
+		return nil, errors.New("ldap user filter must contain exactly one %s")
+	}
+
+	if config.LoginAttribute == "" {
+		config.LoginAttribute = "uid"
+	}
+
+	if config.NameAttribute == "" {
+		config.NameAttribute = "cn"
+	}
+
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+
+	mapping := make(map[string]string)
+	for group, level := range config.RoleMapping {
+		mapping[strings.ToLower(group)] = level
+	}
+	config.RoleMapping = mapping
+
+	u, err := url.Parse(config.Url)
+	if err != nil {
+		return nil, fmt.Errorf("bad ldap url: %v", err)
+	}
+
+	// StartTLS upgrades a connection that is already open, so unlike ldaps://
+	// nothing fills in the name to check the server's certificate against.
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: config.InsecureSkipVerify}
+
+	if config.CaFile != "" {
+		pem, err := ioutil.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", config.CaFile)
+		}
+	}
+
+	return &Ldap{Config: config, DB: db, Dial: dial, tlsConfig: tlsConfig}, nil
+}
+
+func (l *Ldap) Authenticate(login string, password string) (*models.User, error) {
+	// An empty password would be an unauthenticated bind, which most servers
+	// report as a success.
+	if password == "" {
+		return nil, ErrWrongPassword
+	}
+
+	conn, err := l.Dial(l.Config.Url, l.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if l.Config.StartTls {
+		err = conn.StartTLS(l.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.Config.BindDn != "" {
+		err = conn.Bind(l.Config.BindDn, l.Config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("ldap service bind: %v", err)
+		}
+	}
+
+	req := ldap.NewSearchRequest(l.Config.BaseDn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.Config.UserFilter, ldap.EscapeFilter(login)),
+		[]string{l.Config.LoginAttribute, l.Config.NameAttribute, l.Config.EmailAttribute, l.Config.GroupAttribute},
+		nil)
+
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Entries) == 0 {
+		return nil, ErrUnknownUser
+	}
+
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("ldap search for %q matched more than one entry", login)
+	}
+
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrWrongPassword
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ident := identity.Identity{Source: "ldap:" + l.Config.Url, Subject: entry.DN,
+		Login: entry.GetAttributeValue(l.Config.LoginAttribute), Name: entry.GetAttributeValue(l.Config.NameAttribute),
+		Email: entry.GetAttributeValue(l.Config.EmailAttribute), EmailVerified: true}
+
+	if ident.Login == "" {
+		ident.Login = login
+	}
+
+	if len(l.Config.RoleMapping) > 0 {
+		var groups []string
+		for _, group := range entry.GetAttributeValues(l.Config.GroupAttribute) {
+			groups = append(groups, strings.ToLower(group))
+		}
+
+		ident.ManageLevel = true
+		ident.Level = identity.MapRole(l.Config.RoleMapping, groups)
+	}
+
+	return identity.FindOrProvisionUser(l.DB, l.Webhooks, ident)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func dial(url string, tlsConfig *tls.Config) (LdapConn, error) {
+	return ldap.DialURL(url, ldap.DialWithTLSConfig(tlsConfig))
+}
@@ -0,0 +1,289 @@
+package authenticators
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// directory is an in-process stand-in for an LDAP server.  Its connections
+// do a real TLS handshake on StartTLS, and it won't take a password over a
+// connection that hasn't been upgraded.
+type directory struct {
+	t         *testing.T
+	tlsConfig *tls.Config
+	caFile    string
+	entries   map[string]*directoryEntry
+	binds     []string
+}
+
+type directoryEntry struct {
+	password string
+	attrs    map[string][]string
+}
+
+func newDirectory(t *testing.T, host string) *directory {
+	d := &directory{t: t, entries: make(map[string]*directoryEntry)}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: host},
+		DNSNames: []string{host}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	d.caFile = filepath.Join(t.TempDir(), "ca.pem")
+
+	err = os.WriteFile(d.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.entries["cn=reader,dc=example,dc=org"] = &directoryEntry{password: "reader-secret"}
+
+	d.entries["uid=alice,ou=people,dc=example,dc=org"] = &directoryEntry{password: "alice-secret",
+		attrs: map[string][]string{"uid": {"alice"}, "cn": {"Alice Example"}, "mail": {"alice@example.org"},
+			"memberOf": {"cn=Editors,ou=groups,dc=example,dc=org"}}}
+
+	d.entries["uid=bob,ou=people,dc=example,dc=org"] = &directoryEntry{password: "bob-secret",
+		attrs: map[string][]string{"uid": {"bob"}, "cn": {"Bob Example"}}}
+
+	return d
+}
+
+func (d *directory) dial(url string, tlsConfig *tls.Config) (LdapConn, error) {
+	return &directoryConn{dir: d}, nil
+}
+
+type directoryConn struct {
+	dir       *directory
+	encrypted bool
+}
+
+func (c *directoryConn) StartTLS(config *tls.Config) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+
+		serverErr <- tls.Server(conn, c.dir.tlsConfig).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = tls.Client(conn, config).Handshake()
+	if err != nil {
+		return err
+	}
+
+	err = <-serverErr
+	if err != nil {
+		return err
+	}
+
+	c.encrypted = true
+
+	return nil
+}
+
+func (c *directoryConn) Bind(username string, password string) error {
+	if !c.encrypted {
+		return errors.New("stand-in directory: bind over an unencrypted connection")
+	}
+
+	entry, ok := c.dir.entries[username]
+	if !ok || entry.password != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+
+	c.dir.binds = append(c.dir.binds, username)
+
+	return nil
+}
+
+// Search only understands the (attr=value) filters the authenticator sends.
+func (c *directoryConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "("), ")")
+
+	parts := strings.SplitN(filter, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("stand-in directory: can't handle filter %q", req.Filter)
+	}
+
+	result := &ldap.SearchResult{}
+
+	for dn, entry := range c.dir.entries {
+		if !strings.HasSuffix(dn, ","+req.BaseDN) {
+			continue
+		}
+
+		for _, value := range entry.attrs[parts[0]] {
+			if ldap.EscapeFilter(value) == parts[1] {
+				result.Entries = append(result.Entries, ldap.NewEntry(dn, entry.attrs))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (c *directoryConn) Close() error {
+	return nil
+}
+
+func newTestDB(t *testing.T) *ivy.DB {
+	dir := t.TempDir()
+
+	for _, name := range []string{"users", "audit", "password_resets", "sessions", "api_tokens", "answers"} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func newTestLdap(t *testing.T, d *directory, config LdapConfig) *Ldap {
+	config.Url = "ldap://ldap.example.org"
+	config.StartTls = true
+	config.CaFile = d.caFile
+	config.BindDn = "cn=reader,dc=example,dc=org"
+	config.BindPassword = "reader-secret"
+	config.BaseDn = "ou=people,dc=example,dc=org"
+
+	l, err := NewLdap(config, newTestDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Dial = d.dial
+
+	return l
+}
+
+func TestLdapStartTlsVerifiesTheServer(t *testing.T) {
+	d := newDirectory(t, "ldap.example.org")
+	l := newTestLdap(t, d, LdapConfig{})
+
+	user, err := l.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+
+	if user.Login != "alice" || user.Name != "Alice Example" || user.Email != "alice@example.org" {
+		t.Errorf("got user %+v", user)
+	}
+
+	if want := []string{"cn=reader,dc=example,dc=org", "uid=alice,ou=people,dc=example,dc=org"}; fmt.Sprint(d.binds) != fmt.Sprint(want) {
+		t.Errorf("binds = %v, want %v", d.binds, want)
+	}
+}
+
+func TestLdapStartTlsRejectsTheWrongServer(t *testing.T) {
+	d := newDirectory(t, "impostor.example.org")
+	l := newTestLdap(t, d, LdapConfig{})
+
+	_, err := l.Authenticate("alice", "alice-secret")
+	if err == nil {
+		t.Fatal("Authenticate succeeded against a certificate for another host")
+	}
+
+	if len(d.binds) != 0 {
+		t.Errorf("sent binds %v to a server that failed verification", d.binds)
+	}
+}
+
+func TestLdapFailures(t *testing.T) {
+	d := newDirectory(t, "ldap.example.org")
+	l := newTestLdap(t, d, LdapConfig{})
+
+	tests := []struct {
+		login    string
+		password string
+		want     error
+	}{
+		{"alice", "wrong", ErrWrongPassword},
+		{"alice", "", ErrWrongPassword},
+		{"carol", "carol-secret", ErrUnknownUser},
+		{"alice)(uid=*", "alice-secret", ErrUnknownUser},
+	}
+
+	for _, tt := range tests {
+		_, err := l.Authenticate(tt.login, tt.password)
+		if err != tt.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.login, tt.password, err, tt.want)
+		}
+	}
+}
+
+func TestLdapRoleMapping(t *testing.T) {
+	d := newDirectory(t, "ldap.example.org")
+	l := newTestLdap(t, d, LdapConfig{RoleMapping: map[string]string{"CN=Editors,OU=Groups,DC=Example,DC=Org": "editor"}})
+
+	alice, err := l.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate alice: %v", err)
+	}
+
+	if alice.Level != "editor" {
+		t.Errorf("alice's level = %q, want editor", alice.Level)
+	}
+
+	bob, err := l.Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatalf("Authenticate bob: %v", err)
+	}
+
+	if bob.Level != "" {
+		t.Errorf("bob's level = %q, want none", bob.Level)
+	}
+}
@@ -0,0 +1,64 @@
+package authenticators
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/models"
+)
+
+// Local checks the bcrypt password stored on the user.
+type Local struct {
+	DB *ivy.DB
+}
+
+func (local Local) Authenticate(login string, password string) (*models.User, error) {
+	users, err := models.UsersWithLogin(local.DB, login)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := liveUser(users, login)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users who came in through LDAP or single sign-on have no password of
+	// their own here; leave them to the other authenticators.
+	if len(user.Password) == 0 {
+		return nil, ErrUnknownUser
+	}
+
+	if !user.PasswordMatches(password) {
+		return nil, ErrWrongPassword
+	}
+
+	return user, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// liveUser picks the user with exactly login.  Logins are unique, but older
+// data can have a user in the trash with the same login as a live one, and
+// the trashed one mustn't lock the live one out.
+func liveUser(users []models.User, login string) (*models.User, error) {
+	var deleted bool
+
+	for i := range users {
+		if users[i].Login != login {
+			continue
+		}
+
+		if !users[i].IsDeleted() {
+			return &users[i], nil
+		}
+
+		deleted = true
+	}
+
+	if deleted {
+		return nil, identity.ErrUserDeleted
+	}
+
+	return nil, ErrUnknownUser
+}
@@ -0,0 +1,86 @@
+package authenticators
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/models"
+	"testing"
+)
+
+func createUser(t *testing.T, db *ivy.DB, login string, password string, deleted bool) string {
+	user := models.User{Login: login}
+
+	err := user.SetPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted {
+		user.MoveToTrash("admin")
+	}
+
+	fileId, err := db.Create("users", user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fileId
+}
+
+func TestLocalSkipsTrashedUsers(t *testing.T) {
+	db := newTestDB(t)
+	local := Local{DB: db}
+
+	createUser(t, db, "erin", "old-password", true)
+
+	_, err := local.Authenticate("erin", "old-password")
+	if err != identity.ErrUserDeleted {
+		t.Errorf("trashed user: got %v, want ErrUserDeleted", err)
+	}
+
+	// Data from before logins were kept unique can have a live user with the
+	// same login as a trashed one.
+	liveId := createUser(t, db, "erin", "new-password", false)
+
+	user, err := local.Authenticate("erin", "new-password")
+	if err != nil {
+		t.Fatalf("live user shadowed by a trashed one: %v", err)
+	}
+
+	if user.FileId != liveId {
+		t.Errorf("logged in as %v, want %v", user.FileId, liveId)
+	}
+
+	_, err = local.Authenticate("erin", "old-password")
+	if err != ErrWrongPassword {
+		t.Errorf("trashed user's password: got %v, want ErrWrongPassword", err)
+	}
+}
+
+func TestLoginTaken(t *testing.T) {
+	db := newTestDB(t)
+
+	trashedId := createUser(t, db, "frank", "password", true)
+
+	tests := []struct {
+		login  string
+		fileId string
+		want   bool
+	}{
+		{"frank", "", true},
+		{"FRANK", "", true},
+		{"frank", trashedId, false},
+		{"grace", "", false},
+	}
+
+	for _, tt := range tests {
+		taken, err := models.LoginTaken(db, tt.login, tt.fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if taken != tt.want {
+			t.Errorf("LoginTaken(%q, %q) = %v, want %v", tt.login, tt.fileId, taken, tt.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Challenge hands out small sums for forms anyone can fill in.  The expected
+// answer travels with the form in a signed token, and a form sent back faster
+// than a person could read it is refused.  Each token is good for one try,
+// right or wrong: its nonce is remembered until the token would have expired
+// anyway, so a bot can't replay a solved token or keep guessing at one.
+type Challenge struct {
+	key      []byte
+	minAge   time.Duration
+	lifetime time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// New returns a Challenge signed with a fresh random key.  Forms handed out
+// before a restart stop working, which is fine for something this short lived.
+func New(minAge time.Duration, lifetime time.Duration) (*Challenge, error) {
+	key := make([]byte, 32)
+
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Challenge{key: key, minAge: minAge, lifetime: lifetime, used: make(map[string]time.Time)}, nil
+}
+
+// Generate returns a question to show the visitor and the token to put in
+// the form alongside it.  Both numbers have two digits, so that there are
+// too many possible answers to guess.
+func (c *Challenge) Generate() (string, string, error) {
+	a, err := rand.Int(rand.Reader, big.NewInt(90))
+	if err != nil {
+		return "", "", err
+	}
+
+	b, err := rand.Int(rand.Reader, big.NewInt(90))
+	if err != nil {
+		return "", "", err
+	}
+
+	nonceBytes := make([]byte, 16)
+
+	_, err = rand.Read(nonceBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	a.Add(a, big.NewInt(10))
+	b.Add(b, big.NewInt(10))
+
+	issued := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(nonceBytes)
+	answer := new(big.Int).Add(a, b).String()
+
+	return fmt.Sprintf("What is %v plus %v?", a, b), issued + "." + nonce + "." + c.sign(issued, nonce, answer), nil
+}
+
+// Verify reports whether answer is the right one for token and the token was
+// handed out neither too recently nor too long ago.  Either way the token is
+// used up, unless it was sent back too soon.
+func (c *Challenge) Verify(token string, answer string) bool {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return false
+	}
+
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(issued, 0))
+	if age < c.minAge || age > c.lifetime {
+		return false
+	}
+
+	if !c.use(parts[1], time.Unix(issued, 0).Add(c.lifetime)) {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[2]), []byte(c.sign(parts[0], parts[1], strings.TrimSpace(answer))))
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func (c *Challenge) sign(issued string, nonce string, answer string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(issued + ":" + nonce + ":" + answer))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// use records that the token with nonce has had its one try, and reports
+// false if it already had.  Nonces are forgotten once their token expires.
+func (c *Challenge) use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for n, e := range c.used {
+		if now.After(e) {
+			delete(c.used, n)
+		}
+	}
+
+	if _, ok := c.used[nonce]; ok {
+		return false
+	}
+
+	c.used[nonce] = expires
+
+	return true
+}
@@ -0,0 +1,102 @@
+package challenge
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func generate(t *testing.T, c *Challenge) (string, string) {
+	question, token, err := c.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a, b int
+
+	_, err = fmt.Sscanf(question, "What is %d plus %d?", &a, &b)
+	if err != nil {
+		t.Fatalf("can't read %q: %v", question, err)
+	}
+
+	if a < 10 || a > 99 || b < 10 || b > 99 {
+		t.Errorf("%q doesn't use two-digit numbers", question)
+	}
+
+	return token, strconv.Itoa(a + b)
+}
+
+func TestTokensAreSingleUse(t *testing.T) {
+	c, err := New(0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, answer := generate(t, c)
+
+	if !c.Verify(token, " "+answer+" ") {
+		t.Fatal("right answer refused")
+	}
+
+	if c.Verify(token, answer) {
+		t.Error("solved token accepted a second time")
+	}
+
+	token, answer = generate(t, c)
+
+	if c.Verify(token, "0") {
+		t.Fatal("wrong answer accepted")
+	}
+
+	if c.Verify(token, answer) {
+		t.Error("token still good after a wrong answer")
+	}
+}
+
+func TestTokenAge(t *testing.T) {
+	c, err := New(time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, answer := generate(t, c)
+
+	if c.Verify(token, answer) {
+		t.Fatal("token accepted straight away")
+	}
+
+	// Sent back too soon doesn't use the token up.
+	c.minAge = 0
+
+	if !c.Verify(token, answer) {
+		t.Error("token refused once old enough")
+	}
+
+	c.lifetime = -time.Second
+	token, answer = generate(t, c)
+
+	if c.Verify(token, answer) {
+		t.Error("expired token accepted")
+	}
+}
+
+func TestForgedTokens(t *testing.T) {
+	c, err := New(0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := New(0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, answer := generate(t, other)
+
+	for _, tok := range []string{token, "", "123", "x.y.z"} {
+		if c.Verify(tok, answer) {
+			t.Errorf("accepted token %q", tok)
+		}
+	}
+}
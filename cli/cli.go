@@ -0,0 +1,247 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"github.com/jameycribbs/pythia/models"
+	"os"
+	"strings"
+)
+
+// Backend is where the answers come from: a local data directory or a
+// server's JSON API.
+type Backend interface {
+	Search(search string) ([]api_handler.Answer, error)
+	Show(id string) (api_handler.Answer, error)
+	Create(input api_handler.AnswerInput) (api_handler.Answer, error)
+	Update(id string, input api_handler.AnswerInput) (api_handler.Answer, error)
+	Tags() ([]api_handler.TagCount, error)
+	Close()
+}
+
+// options are the flags every command takes.
+type options struct {
+	server  string
+	token   string
+	dataDir string
+	login   string
+	json    bool
+	noColor bool
+}
+
+var commands = map[string]func(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error{
+	"search": search,
+	"show":   show,
+	"add":    add,
+	"edit":   edit,
+	"tags":   tags,
+}
+
+// addFlags are the extra flags taken by "add".
+var addFlags struct {
+	question string
+	answer   string
+	tags     string
+	status   string
+}
+
+// IsCommand reports whether name is one of the answer commands.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+
+	return ok
+}
+
+// Run runs the answer command name with the rest of the command line.
+func Run(name string, args []string) error {
+	var opts options
+
+	run, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %v", name)
+	}
+
+	flags := flag.NewFlagSet("pythia "+name, flag.ExitOnError)
+	flags.StringVar(&opts.server, "server", os.Getenv("PYTHIA_SERVER"),
+		"URL of a Pythia server to use instead of a local data directory (defaults to $PYTHIA_SERVER)")
+	flags.StringVar(&opts.token, "token", os.Getenv("PYTHIA_TOKEN"),
+		"API token from your account page, for -server (defaults to $PYTHIA_TOKEN)")
+	flags.StringVar(&opts.dataDir, "data", "data", "local data directory")
+	flags.StringVar(&opts.login, "as", os.Getenv("PYTHIA_LOGIN"),
+		"login to make changes to a local data directory as (defaults to $PYTHIA_LOGIN)")
+	flags.BoolVar(&opts.json, "json", false, "print JSON instead of text")
+	flags.BoolVar(&opts.noColor, "no-color", os.Getenv("NO_COLOR") != "", "don't color the output")
+
+	if name == "add" {
+		flags.StringVar(&addFlags.question, "question", "", "the question (opens $EDITOR when this or -answer is missing)")
+		flags.StringVar(&addFlags.answer, "answer", "", "the answer")
+		flags.StringVar(&addFlags.tags, "tags", "", "tags separated by spaces")
+		flags.StringVar(&addFlags.status, "status", models.StatusDraft, "draft, pending or published")
+	}
+
+	flags.Parse(args)
+
+	var backend Backend
+
+	if opts.server != "" {
+		backend = NewRemote(opts.server, opts.token)
+	} else {
+		local, err := OpenLocal(opts.dataDir, opts.login)
+		if err != nil {
+			return err
+		}
+
+		backend = local
+	}
+	defer backend.Close()
+
+	return run(backend, flags, &opts, newPrinter(os.Stdout, !opts.noColor && !opts.json))
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func search(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error {
+	if flags.NArg() == 0 {
+		return errors.New("give one or more tags to search for, or \"all\"")
+	}
+
+	answers, err := backend.Search(strings.Join(flags.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return printJson(answers)
+	}
+
+	if len(answers) == 0 {
+		out.line(out.dim("No answers found."))
+		return nil
+	}
+
+	for _, answer := range answers {
+		out.summary(answer)
+	}
+
+	return nil
+}
+
+func show(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error {
+	if flags.NArg() != 1 {
+		return errors.New("give the id of the answer to show")
+	}
+
+	answer, err := backend.Show(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return printJson(answer)
+	}
+
+	out.detail(answer)
+
+	return nil
+}
+
+func add(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error {
+	input := api_handler.AnswerInput{Question: addFlags.question, Answer: addFlags.answer,
+		Tags: strings.Fields(addFlags.tags), Status: addFlags.status}
+
+	if input.Question == "" || input.Answer == "" {
+		var err error
+
+		input, err = editInput(input)
+		if err != nil {
+			return err
+		}
+	}
+
+	if input.Question == "" || input.Answer == "" {
+		return errors.New("the question and answer can't be empty")
+	}
+
+	answer, err := backend.Create(input)
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return printJson(answer)
+	}
+
+	out.line(fmt.Sprintf("Added answer %v (%v).", out.bold(answer.Id), answer.Status))
+
+	return nil
+}
+
+func edit(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error {
+	if flags.NArg() != 1 {
+		return errors.New("give the id of the answer to edit")
+	}
+
+	current, err := backend.Show(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	before := api_handler.AnswerInput{Question: current.Question, Answer: current.Answer.Answer,
+		Tags: current.Tags}
+
+	input, err := editInput(before)
+	if err != nil {
+		return err
+	}
+
+	if input.Question == "" || input.Answer == "" {
+		return errors.New("the question and answer can't be empty")
+	}
+
+	if input.Question == before.Question && input.Answer == before.Answer &&
+		strings.Join(input.Tags, " ") == strings.Join(before.Tags, " ") {
+		out.line(out.dim("No changes."))
+		return nil
+	}
+
+	answer, err := backend.Update(current.Id, input)
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return printJson(answer)
+	}
+
+	out.line(fmt.Sprintf("Saved answer %v.", out.bold(answer.Id)))
+
+	return nil
+}
+
+func tags(backend Backend, flags *flag.FlagSet, opts *options, out *printer) error {
+	counts, err := backend.Tags()
+	if err != nil {
+		return err
+	}
+
+	if opts.json {
+		return printJson(counts)
+	}
+
+	for _, count := range counts {
+		out.line(fmt.Sprintf("%v %v", out.yellow(count.Tag), out.dim(fmt.Sprintf("(%v)", count.Count))))
+	}
+
+	return nil
+}
+
+func printJson(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(v)
+}
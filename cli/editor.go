@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// editInput lets the user change input in $VISUAL or $EDITOR (vi when neither
+// is set) and returns what they saved.  The file looks like:
+//
+//	Tags: rout minefield
+//
+//	Question:
+//	...
+//
+//	Answer:
+//	...
+func editInput(input api_handler.AnswerInput) (api_handler.AnswerInput, error) {
+	f, err := ioutil.TempFile("", "pythia-*.txt")
+	if err != nil {
+		return input, err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = fmt.Fprintf(f, "Tags: %v\n\nQuestion:\n%v\n\nAnswer:\n%v\n", strings.Join(input.Tags, " "),
+		input.Question, input.Answer)
+	f.Close()
+	if err != nil {
+		return input, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// $EDITOR may carry arguments, as in "code --wait".
+	words := strings.Fields(editor)
+
+	cmd := exec.Command(words[0], append(words[1:], f.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return input, fmt.Errorf("%v: %v", editor, err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return input, err
+	}
+
+	return parseInput(string(b), input)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// parseInput reads back the file written by editInput.  Anything not in the
+// file, such as the status, is kept from input.
+func parseInput(text string, input api_handler.AnswerInput) (api_handler.AnswerInput, error) {
+	var question, answer []string
+	var section *[]string
+
+	foundQuestion, foundAnswer := false, false
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case section == nil && strings.HasPrefix(line, "Tags:"):
+			input.Tags = strings.Fields(strings.TrimPrefix(line, "Tags:"))
+		case strings.TrimSpace(line) == "Question:" && !foundQuestion:
+			section = &question
+			foundQuestion = true
+		case strings.TrimSpace(line) == "Answer:" && !foundAnswer:
+			section = &answer
+			foundAnswer = true
+		case section != nil:
+			*section = append(*section, line)
+		}
+	}
+
+	if !foundQuestion || !foundAnswer {
+		return input, errors.New("the file must keep its Question: and Answer: lines")
+	}
+
+	input.Question = strings.TrimSpace(strings.Join(question, "\n"))
+	input.Answer = strings.TrimSpace(strings.Join(answer, "\n"))
+
+	return input, nil
+}
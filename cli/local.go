@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/data_lock"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/handlers/answers_handler"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/record_lock"
+	"time"
+)
+
+// Local reads and writes a data directory directly.  Changes are made as the
+// user with the login given to OpenLocal, if any, and are written to the
+// audit log, but no emails or webhooks are sent.  While the server is using
+// the data directory, answers can be read but not changed.
+type Local struct {
+	gv      *global_vars.GlobalVars
+	user    *models.User
+	lock    *data_lock.Lock
+	lockErr error
+}
+
+func OpenLocal(dir string, login string) (*Local, error) {
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	local := &Local{gv: &global_vars.GlobalVars{MyDB: db, Locks: record_lock.New()}}
+
+	local.lock, err = data_lock.Acquire(dir)
+	if errors.Is(err, data_lock.ErrLocked) {
+		local.lockErr = fmt.Errorf("%v; use -server to make changes while the server is running", err)
+	} else if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if login != "" {
+		var user models.User
+
+		id, err := db.FindFirstIdForField("users", "login", login)
+		if err != nil {
+			local.Close()
+			return nil, fmt.Errorf("no user with the login %v", login)
+		}
+
+		err = db.Find("users", &user, id)
+		if err != nil {
+			local.Close()
+			return nil, err
+		}
+
+		if user.IsDeleted() {
+			local.Close()
+			return nil, fmt.Errorf("the user %v has been deleted", login)
+		}
+
+		local.user = &user
+	}
+
+	return local, nil
+}
+
+func (l *Local) Close() {
+	l.gv.MyDB.Close()
+
+	if l.lock != nil {
+		l.lock.Release()
+	}
+}
+
+func (l *Local) Search(search string) ([]api_handler.Answer, error) {
+	answers, err := answers_handler.Search(l.gv, search, l.user)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []api_handler.Answer{}
+
+	for _, answer := range answers {
+		results = append(results, api_handler.Answer{Id: answer.FileId, Answer: answer})
+	}
+
+	return results, nil
+}
+
+func (l *Local) Show(id string) (api_handler.Answer, error) {
+	var rec models.Answer
+
+	err := l.gv.MyDB.Find("answers", &rec, id)
+	if err != nil || rec.IsDeleted() || !rec.VisibleTo(l.user) {
+		return api_handler.Answer{}, errors.New("no such answer")
+	}
+
+	return api_handler.Answer{Id: id, Answer: &rec}, nil
+}
+
+func (l *Local) Create(input api_handler.AnswerInput) (api_handler.Answer, error) {
+	if l.user == nil {
+		return api_handler.Answer{}, errors.New("use -as <login> to say who is adding the answer")
+	}
+
+	if l.lockErr != nil {
+		return api_handler.Answer{}, l.lockErr
+	}
+
+	rec := models.Answer{Question: input.Question, Answer: input.Answer, Tags: input.Tags,
+		Status: models.InitialStatus(input.Status, l.user), CreatedById: l.user.FileId, CreatedAt: time.Now(),
+		UpdatedById: l.user.FileId, UpdatedAt: time.Now()}
+
+	fileId, err := l.gv.MyDB.Create("answers", rec)
+	if err != nil {
+		return api_handler.Answer{}, err
+	}
+
+	audit.Record(l.gv.MyDB, nil, audit.Event{Actor: l.user, Action: "create", Collection: "answers", TargetId: fileId,
+		Detail: "command line", After: rec})
+
+	rec.FileId = fileId
+
+	return api_handler.Answer{Id: fileId, Answer: &rec}, nil
+}
+
+func (l *Local) Update(id string, input api_handler.AnswerInput) (api_handler.Answer, error) {
+	if l.user == nil {
+		return api_handler.Answer{}, errors.New("use -as <login> to say who is editing the answer")
+	}
+
+	if l.lockErr != nil {
+		return api_handler.Answer{}, l.lockErr
+	}
+
+	defer l.gv.Locks.Lock("answers", id)()
+
+	current, err := l.Show(id)
+	if err != nil {
+		return current, err
+	}
+
+	rec := *current.Answer
+
+	if !rec.EditableBy(l.user) {
+		return current, errors.New("you may not edit this answer")
+	}
+
+	before := rec
+
+	rec.Question = input.Question
+	rec.Answer = input.Answer
+	rec.Tags = input.Tags
+	rec.UpdatedById = l.user.FileId
+	rec.UpdatedAt = time.Now()
+
+	err = l.gv.MyDB.Update("answers", rec, id)
+	if err != nil {
+		return current, err
+	}
+
+	audit.Record(l.gv.MyDB, nil, audit.Event{Actor: l.user, Action: "update", Collection: "answers", TargetId: id,
+		Detail: "command line", Before: before, After: rec})
+
+	return api_handler.Answer{Id: id, Answer: &rec}, nil
+}
+
+func (l *Local) Tags() ([]api_handler.TagCount, error) {
+	answers, err := answers_handler.Search(l.gv, "all", l.user)
+	if err != nil {
+		return nil, err
+	}
+
+	return api_handler.CountTags(answers), nil
+}
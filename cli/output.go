@@ -0,0 +1,145 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const indent = "    "
+
+// printer writes answers for a person at a terminal: wrapped to the width of
+// the terminal and, when color is on, colored with ANSI escapes.
+type printer struct {
+	w     io.Writer
+	color bool
+	width int
+}
+
+// newPrinter only colors output going to a terminal.  The width comes from
+// $COLUMNS, which most shells set, or is 80.
+func newPrinter(f *os.File, color bool) *printer {
+	if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		color = false
+	}
+
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 20 {
+		width = 80
+	}
+
+	return &printer{w: f, color: color, width: width}
+}
+
+func (p *printer) line(s string) {
+	fmt.Fprintln(p.w, s)
+}
+
+// summary is how an answer is listed in search results.
+func (p *printer) summary(answer api_handler.Answer) {
+	p.line(p.dim("#"+answer.Id) + " " + p.bold(p.cyan(oneLine(answer.Question))))
+	p.wrapped(answer.Answer.Answer, indent)
+	p.line(indent + p.tagList(answer.Tags))
+	p.line("")
+}
+
+// detail is how "show" prints an answer.
+func (p *printer) detail(answer api_handler.Answer) {
+	p.line(p.bold(p.cyan("Question")) + p.dim(" #"+answer.Id))
+	p.wrapped(answer.Question, indent)
+	p.line("")
+	p.line(p.bold(p.cyan("Answer")))
+	p.wrapped(answer.Answer.Answer, indent)
+	p.line("")
+
+	p.field("Tags", p.tagList(answer.Tags))
+	p.field("Status", answer.Status)
+
+	if answer.Source.Type != "" {
+		source := answer.Source.Label()
+		if answer.Source.Reference != "" {
+			source += ", " + answer.Source.Reference
+		}
+
+		if answer.Source.Url != "" {
+			source += " " + p.dim(answer.Source.Url)
+		}
+
+		p.field("Source", source)
+	}
+
+	if answer.Confidence != "" {
+		p.field("Confidence", answer.Confidence)
+	}
+
+	if len(answer.Rules) > 0 {
+		p.field("Rules", strings.Join(answer.Rules, " "))
+	}
+
+	p.field("Updated", answer.UpdatedAt.Format("2006-01-02 15:04"))
+}
+
+func (p *printer) field(name string, value string) {
+	p.line(p.bold(fmt.Sprintf("%-11v", name+":")) + " " + value)
+}
+
+func (p *printer) tagList(tags []string) string {
+	var colored []string
+
+	for _, tag := range tags {
+		if tag != "" {
+			colored = append(colored, p.yellow(tag))
+		}
+	}
+
+	return strings.Join(colored, " ")
+}
+
+// wrapped prints s word-wrapped with each line indented by prefix, keeping
+// its paragraphs apart.
+func (p *printer) wrapped(s string, prefix string) {
+	for i, paragraph := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n\n") {
+		if i > 0 {
+			p.line("")
+		}
+
+		line := prefix
+
+		for _, word := range strings.Fields(paragraph) {
+			if line != prefix && len([]rune(line))+1+len([]rune(word)) > p.width {
+				p.line(line)
+				line = prefix
+			}
+
+			if line != prefix {
+				line += " "
+			}
+
+			line += word
+		}
+
+		if line != prefix {
+			p.line(line)
+		}
+	}
+}
+
+func (p *printer) bold(s string) string   { return p.ansi("1", s) }
+func (p *printer) dim(s string) string    { return p.ansi("2", s) }
+func (p *printer) cyan(s string) string   { return p.ansi("36", s) }
+func (p *printer) yellow(s string) string { return p.ansi("33", s) }
+
+func (p *printer) ansi(code string, s string) string {
+	if !p.color {
+		return s
+	}
+
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Remote talks to a Pythia server's JSON API with an API token from the
+// account page.  Without a token it can only read published answers.
+type Remote struct {
+	Url    string
+	Token  string
+	client *http.Client
+}
+
+func NewRemote(serverUrl string, token string) *Remote {
+	return &Remote{Url: strings.TrimSuffix(serverUrl, "/"), Token: token,
+		client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (c *Remote) Close() {}
+
+func (c *Remote) Search(search string) ([]api_handler.Answer, error) {
+	var answers []api_handler.Answer
+
+	err := c.do("GET", "/api/answers?search="+url.QueryEscape(search), nil, &answers)
+
+	return answers, err
+}
+
+func (c *Remote) Show(id string) (api_handler.Answer, error) {
+	var answer api_handler.Answer
+
+	err := c.do("GET", "/api/answers/"+url.PathEscape(id), nil, &answer)
+
+	return answer, err
+}
+
+func (c *Remote) Create(input api_handler.AnswerInput) (api_handler.Answer, error) {
+	var answer api_handler.Answer
+
+	err := c.do("POST", "/api/answers", input, &answer)
+
+	return answer, err
+}
+
+func (c *Remote) Update(id string, input api_handler.AnswerInput) (api_handler.Answer, error) {
+	var answer api_handler.Answer
+
+	err := c.do("PUT", "/api/answers/"+url.PathEscape(id), input, &answer)
+
+	return answer, err
+}
+
+func (c *Remote) Tags() ([]api_handler.TagCount, error) {
+	var tags []api_handler.TagCount
+
+	err := c.do("GET", "/api/tags", nil, &tags)
+
+	return tags, err
+}
+
+// do sends one API request and decodes the JSON reply into out.  Error
+// replies carry their message in an "error" field.
+func (c *Remote) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.Url+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+
+		if json.NewDecoder(resp.Body).Decode(&apiError) == nil && apiError.Error != "" {
+			return errors.New(apiError.Error)
+		}
+
+		return fmt.Errorf("server said %v", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
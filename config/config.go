@@ -0,0 +1,495 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/jameycribbs/pythia/authenticators"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/oidc_auth"
+	"github.com/jameycribbs/pythia/request_info"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config is every setting the server takes.  Each one comes from, in order of
+// precedence, a command line flag, an environment variable, the config file
+// or its default.
+type Config struct {
+	Listen        string `yaml:"listen" toml:"listen"`
+	MetricsListen string `yaml:"metrics_listen" toml:"metrics_listen"`
+	BaseUrl       string `yaml:"base_url" toml:"base_url"`
+	DataDir       string `yaml:"data_dir" toml:"data_dir"`
+	TemplatesDir  string `yaml:"templates_dir" toml:"templates_dir"`
+	StaticDir     string `yaml:"static_dir" toml:"static_dir"`
+
+	VerifyInterval time.Duration `yaml:"verify_interval" toml:"verify_interval"`
+	TrashRetention time.Duration `yaml:"trash_retention" toml:"trash_retention"`
+
+	Http     Http     `yaml:"http" toml:"http"`
+	Session  Session  `yaml:"session" toml:"session"`
+	Tls      Tls      `yaml:"tls" toml:"tls"`
+	Log      Log      `yaml:"log" toml:"log"`
+	Features Features `yaml:"features" toml:"features"`
+	Oidc     Oidc     `yaml:"oidc" toml:"oidc"`
+	Ldap     Ldap     `yaml:"ldap" toml:"ldap"`
+	Mail     Mail     `yaml:"mail" toml:"mail"`
+	Chat     Chat     `yaml:"chat" toml:"chat"`
+}
+
+// Http holds the server's timeouts.  ShutdownTimeout is how long requests in
+// progress get to finish after SIGINT or SIGTERM.  TrustedProxies lists the
+// reverse proxies, as addresses or CIDR networks separated by commas, whose
+// X-Forwarded-For header is believed.
+type Http struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	TrustedProxies    string        `yaml:"trusted_proxies" toml:"trusted_proxies"`
+}
+
+// Session settings.  Keys, when set, holds the cookie keys themselves in the
+// format of the keys file with commas between keys, and KeysFile is ignored.
+type Session struct {
+	KeysFile       string        `yaml:"keys_file" toml:"keys_file"`
+	Keys           string        `yaml:"keys" toml:"keys"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	MaxAge         time.Duration `yaml:"max_age" toml:"max_age"`
+	CookieSecure   bool          `yaml:"cookie_secure" toml:"cookie_secure"`
+	CookieDomain   string        `yaml:"cookie_domain" toml:"cookie_domain"`
+	CookieSameSite string        `yaml:"cookie_samesite" toml:"cookie_samesite"`
+}
+
+// Tls turns on HTTPS when both files are given.  RedirectFrom is an extra
+// plain HTTP address that only redirects to HTTPS.  A HstsMaxAge of 0 leaves
+// out the Strict-Transport-Security header.
+type Tls struct {
+	CertFile              string        `yaml:"cert_file" toml:"cert_file"`
+	KeyFile               string        `yaml:"key_file" toml:"key_file"`
+	RedirectFrom          string        `yaml:"redirect_from" toml:"redirect_from"`
+	HstsMaxAge            time.Duration `yaml:"hsts_max_age" toml:"hsts_max_age"`
+	HstsIncludeSubdomains bool          `yaml:"hsts_include_subdomains" toml:"hsts_include_subdomains"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+}
+
+type Features struct {
+	RequireAdminTwoFactor bool `yaml:"require_admin_2fa" toml:"require_admin_2fa"`
+	Api                   bool `yaml:"api" toml:"api"`
+}
+
+type Oidc struct {
+	Name         string `yaml:"name" toml:"name"`
+	IssuerUrl    string `yaml:"issuer" toml:"issuer"`
+	ClientId     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+	RedirectUrl  string `yaml:"redirect_url" toml:"redirect_url"`
+	GroupsClaim  string `yaml:"groups_claim" toml:"groups_claim"`
+	RoleMap      string `yaml:"role_map" toml:"role_map"`
+}
+
+type Ldap struct {
+	Url                string `yaml:"url" toml:"url"`
+	StartTls           bool   `yaml:"starttls" toml:"starttls"`
+	CaFile             string `yaml:"ca_file" toml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+	BindDn             string `yaml:"bind_dn" toml:"bind_dn"`
+	BindPassword       string `yaml:"bind_password" toml:"bind_password"`
+	BaseDn             string `yaml:"base_dn" toml:"base_dn"`
+	UserFilter         string `yaml:"user_filter" toml:"user_filter"`
+	LoginAttribute     string `yaml:"login_attribute" toml:"login_attribute"`
+	NameAttribute      string `yaml:"name_attribute" toml:"name_attribute"`
+	EmailAttribute     string `yaml:"email_attribute" toml:"email_attribute"`
+	GroupAttribute     string `yaml:"group_attribute" toml:"group_attribute"`
+	RoleMap            string `yaml:"role_map" toml:"role_map"`
+}
+
+type Mail struct {
+	SmtpAddr     string `yaml:"smtp_addr" toml:"smtp_addr"`
+	SmtpUsername string `yaml:"smtp_username" toml:"smtp_username"`
+	SmtpPassword string `yaml:"smtp_password" toml:"smtp_password"`
+	From         string `yaml:"from" toml:"from"`
+	Outbox       string `yaml:"outbox" toml:"outbox"`
+}
+
+type Chat struct {
+	SigningSecret string `yaml:"signing_secret" toml:"signing_secret"`
+	Token         string `yaml:"token" toml:"token"`
+}
+
+// defaultFiles are looked for in the working directory when no config file
+// is named.
+var defaultFiles = []string{"pythia.yaml", "pythia.yml", "pythia.toml"}
+
+func Defaults() Config {
+	return Config{
+		Listen:         ":8080",
+		DataDir:        "data",
+		TemplatesDir:   "templates",
+		StaticDir:      "static",
+		VerifyInterval: 180 * 24 * time.Hour,
+		TrashRetention: 30 * 24 * time.Hour,
+		Http: Http{ReadHeaderTimeout: 10 * time.Second, ReadTimeout: 30 * time.Second, WriteTimeout: time.Minute,
+			IdleTimeout: 2 * time.Minute, ShutdownTimeout: 30 * time.Second},
+		Session: Session{KeysFile: "session.keys", IdleTimeout: 7 * 24 * time.Hour, MaxAge: 30 * 24 * time.Hour,
+			CookieSameSite: "lax"},
+		Tls:      Tls{HstsMaxAge: 180 * 24 * time.Hour},
+		Log:      Log{Level: "info", Format: "text"},
+		Features: Features{Api: true},
+		Oidc:     Oidc{Name: "Single Sign-On", GroupsClaim: "groups"},
+		Ldap: Ldap{UserFilter: "(uid=%s)", LoginAttribute: "uid", NameAttribute: "cn", EmailAttribute: "mail",
+			GroupAttribute: "memberOf"},
+		Mail: Mail{From: "pythia@localhost"},
+	}
+}
+
+// Load works out the configuration from the defaults, the config file (named
+// by -config or $PYTHIA_CONFIG, otherwise one of defaultFiles if present),
+// the environment and args, in that order.  It adds a flag for every setting
+// to flags, which may already have flags of the caller's own, and parses args
+// with it.  It doesn't validate the result.
+func Load(flags *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Defaults()
+
+	configFile := flags.String("config", os.Getenv("PYTHIA_CONFIG"),
+		"YAML or TOML config file (defaults to $PYTHIA_CONFIG, then pythia.yaml or pythia.toml if present)")
+
+	settings := cfg.settings()
+
+	for _, s := range settings {
+		flags.Var(s.value, s.flag, s.usage+" ($"+envName(s.flag)+")")
+	}
+
+	flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", strings.Join(flags.Args(), " "))
+	}
+
+	// Parsing the flags wrote them into cfg.  Note which were given, then
+	// start again from the defaults so that the file and the environment can
+	// go underneath them.
+	var given []*flag.Flag
+
+	flags.Visit(func(f *flag.Flag) {
+		if isSetting(settings, f.Name) {
+			given = append(given, f)
+		}
+	})
+
+	values := make([]string, len(given))
+	for i, f := range given {
+		values[i] = f.Value.String()
+	}
+
+	cfg = Defaults()
+
+	path := *configFile
+	if path == "" {
+		for _, candidate := range defaultFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+
+	if path != "" {
+		err := readFile(&cfg, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := os.LookupEnv(envName(s.flag))
+		if !ok {
+			continue
+		}
+
+		err := s.value.Set(value)
+		if err != nil {
+			return nil, fmt.Errorf("$%v: %v", envName(s.flag), err)
+		}
+	}
+
+	for i, f := range given {
+		err := f.Value.Set(values[i])
+		if err != nil {
+			return nil, fmt.Errorf("-%v: %v", f.Name, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks the settings that can be checked without starting
+// anything, and reports every problem at once.
+func (cfg *Config) Validate() error {
+	var problems []string
+
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		problem("listen: %v", err)
+	}
+
+	if cfg.MetricsListen != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsListen); err != nil {
+			problem("metrics_listen: %v", err)
+		} else if cfg.MetricsListen == cfg.Listen {
+			problem("metrics_listen must be a different address from listen")
+		}
+	}
+
+	if cfg.BaseUrl != "" {
+		u, err := url.Parse(cfg.BaseUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("base_url: %q is not an http or https URL", cfg.BaseUrl)
+		}
+	}
+
+	for _, dir := range []struct{ key, path string }{
+		{"data_dir", cfg.DataDir}, {"templates_dir", cfg.TemplatesDir}, {"static_dir", cfg.StaticDir}} {
+
+		fi, err := os.Stat(dir.path)
+		if err != nil {
+			problem("%v: %v", dir.key, err)
+		} else if !fi.IsDir() {
+			problem("%v: %v is not a directory", dir.key, dir.path)
+		}
+	}
+
+	if cfg.VerifyInterval <= 0 {
+		problem("verify_interval must be more than 0")
+	}
+
+	if cfg.TrashRetention < 0 {
+		problem("trash_retention can't be negative")
+	}
+
+	if cfg.Http.ReadHeaderTimeout <= 0 || cfg.Http.ReadTimeout <= 0 || cfg.Http.WriteTimeout <= 0 ||
+		cfg.Http.IdleTimeout <= 0 || cfg.Http.ShutdownTimeout <= 0 {
+
+		problem("http: every timeout must be more than 0")
+	}
+
+	if cfg.Session.Keys == "" && cfg.Session.KeysFile == "" {
+		problem("session: one of keys or keys_file is needed")
+	}
+
+	if cfg.Session.IdleTimeout <= 0 || cfg.Session.MaxAge <= 0 {
+		problem("session: idle_timeout and max_age must be more than 0")
+	}
+
+	switch cfg.Session.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !cfg.CookiesSecure() {
+			problem("session: cookie_samesite none needs cookie_secure or TLS")
+		}
+	default:
+		problem("session: cookie_samesite must be lax, strict or none")
+	}
+
+	if _, err := request_info.ParseNetworks(cfg.Http.TrustedProxies); err != nil {
+		problem("http: trusted_proxies: %v", err)
+	}
+
+	if (cfg.Tls.CertFile == "") != (cfg.Tls.KeyFile == "") {
+		problem("tls: cert_file and key_file go together")
+	}
+
+	if cfg.Tls.RedirectFrom != "" {
+		if !cfg.TlsEnabled() {
+			problem("tls: redirect_from needs cert_file and key_file")
+		}
+
+		if _, _, err := net.SplitHostPort(cfg.Tls.RedirectFrom); err != nil {
+			problem("tls: redirect_from: %v", err)
+		}
+	}
+
+	if cfg.Tls.HstsMaxAge < 0 {
+		problem("tls: hsts_max_age can't be negative")
+	}
+
+	for _, file := range []struct{ key, path string }{{"tls: cert_file", cfg.Tls.CertFile},
+		{"tls: key_file", cfg.Tls.KeyFile}, {"ldap: ca_file", cfg.Ldap.CaFile}} {
+
+		if file.path != "" {
+			if _, err := os.Stat(file.path); err != nil {
+				problem("%v: %v", file.key, err)
+			}
+		}
+	}
+
+	if !oneOf(cfg.Log.Level, "debug", "info", "warn", "error") {
+		problem("log: level must be debug, info, warn or error")
+	}
+
+	if !oneOf(cfg.Log.Format, "text", "json") {
+		problem("log: format must be text or json")
+	}
+
+	if cfg.Oidc.IssuerUrl != "" {
+		if cfg.Oidc.ClientId == "" || cfg.Oidc.RedirectUrl == "" {
+			problem("oidc: client_id and redirect_url are needed with issuer")
+		}
+
+		if _, err := identity.ParseRoleMapping(cfg.Oidc.RoleMap, ","); err != nil {
+			problem("oidc: role_map: %v", err)
+		}
+	}
+
+	if cfg.Ldap.Url != "" {
+		if cfg.Ldap.BaseDn == "" {
+			problem("ldap: base_dn is needed with url")
+		}
+
+		if !strings.Contains(cfg.Ldap.UserFilter, "%s") {
+			problem("ldap: user_filter must contain %%s for the login")
+		}
+
+		if _, err := identity.ParseRoleMapping(cfg.Ldap.RoleMap, ";"); err != nil {
+			problem("ldap: role_map: %v", err)
+		}
+	}
+
+	// Links sent out of the site are never built from a request's Host
+	// header, which whoever sends the request controls.
+	if cfg.MailEnabled() {
+		if _, err := mail.ParseAddress(cfg.Mail.From); err != nil {
+			problem("mail: from: %v", err)
+		}
+
+		if cfg.BaseUrl == "" {
+			problem("base_url: needed for the links in emails")
+		}
+	}
+
+	if (cfg.Chat.SigningSecret != "" || cfg.Chat.Token != "") && cfg.BaseUrl == "" {
+		problem("base_url: needed for the links in chat replies")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+}
+
+func (cfg *Config) TlsEnabled() bool {
+	return cfg.Tls.CertFile != "" && cfg.Tls.KeyFile != ""
+}
+
+// CookiesSecure reports whether cookies should only be sent over HTTPS, which
+// they always are when the server itself speaks HTTPS.
+func (cfg *Config) CookiesSecure() bool {
+	return cfg.Session.CookieSecure || cfg.TlsEnabled()
+}
+
+func (cfg *Config) MailEnabled() bool {
+	return cfg.Mail.Outbox != "" || cfg.Mail.SmtpAddr != ""
+}
+
+// OidcConfig is the single sign-on part of the configuration as oidc_auth
+// wants it.  Call it only after Validate.
+func (cfg *Config) OidcConfig() oidc_auth.Config {
+	roleMapping, _ := identity.ParseRoleMapping(cfg.Oidc.RoleMap, ",")
+
+	return oidc_auth.Config{Name: cfg.Oidc.Name, IssuerUrl: cfg.Oidc.IssuerUrl, ClientId: cfg.Oidc.ClientId,
+		ClientSecret: cfg.Oidc.ClientSecret, RedirectUrl: cfg.Oidc.RedirectUrl, GroupsClaim: cfg.Oidc.GroupsClaim,
+		RoleMapping: roleMapping}
+}
+
+// LdapConfig is the LDAP part of the configuration as authenticators wants
+// it.  Call it only after Validate.
+func (cfg *Config) LdapConfig() authenticators.LdapConfig {
+	roleMapping, _ := identity.ParseRoleMapping(cfg.Ldap.RoleMap, ";")
+
+	return authenticators.LdapConfig{Url: cfg.Ldap.Url, StartTls: cfg.Ldap.StartTls, CaFile: cfg.Ldap.CaFile,
+		InsecureSkipVerify: cfg.Ldap.InsecureSkipVerify, BindDn: cfg.Ldap.BindDn, BindPassword: cfg.Ldap.BindPassword,
+		BaseDn: cfg.Ldap.BaseDn, UserFilter: cfg.Ldap.UserFilter, LoginAttribute: cfg.Ldap.LoginAttribute,
+		NameAttribute: cfg.Ldap.NameAttribute, EmailAttribute: cfg.Ldap.EmailAttribute,
+		GroupAttribute: cfg.Ldap.GroupAttribute, RoleMapping: roleMapping}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+
+// readFile decodes a YAML or TOML file over cfg, so settings missing from the
+// file keep their defaults.  Unknown keys are errors, to catch typos.
+func readFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		md, err := toml.NewDecoder(f).Decode(cfg)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			var keys []string
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			sort.Strings(keys)
+
+			return fmt.Errorf("%v: unknown settings %v", path, strings.Join(keys, ", "))
+		}
+
+		return nil
+	}
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	err = dec.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+
+	return nil
+}
+
+func isSetting(settings []setting, flagName string) bool {
+	for _, s := range settings {
+		if s.flag == flagName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func oneOf(s string, choices ...string) bool {
+	for _, choice := range choices {
+		if s == choice {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+)
+
+const redacted = "(hidden)"
+
+// Print writes cfg as a YAML or TOML config file.  Secrets that are set are
+// replaced with a placeholder unless showSecrets is true.
+func Print(w io.Writer, cfg *Config, format string, showSecrets bool) error {
+	shown := *cfg
+
+	if !showSecrets {
+		for _, s := range shown.settings() {
+			if s.secret && s.value.String() != "" {
+				s.value.Set(redacted)
+			}
+		}
+	}
+
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+
+		err := enc.Encode(shown)
+		if err != nil {
+			return err
+		}
+
+		return enc.Close()
+	case "toml":
+		return toml.NewEncoder(w).Encode(shown)
+	default:
+		return fmt.Errorf("unknown format %v, use yaml or toml", format)
+	}
+}
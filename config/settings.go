@@ -0,0 +1,148 @@
+package config
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setting ties a field of Config to its command line flag.  Its environment
+// variable is the flag name in capitals with a PYTHIA_ prefix, e.g.
+// -oidc-client-secret and $PYTHIA_OIDC_CLIENT_SECRET.
+type setting struct {
+	flag   string
+	value  flag.Value
+	usage  string
+	secret bool
+}
+
+func (cfg *Config) settings() []setting {
+	return []setting{
+		{"listen", (*stringValue)(&cfg.Listen), "address to listen on, host:port", false},
+		{"metrics-listen", (*stringValue)(&cfg.MetricsListen),
+			"address to serve Prometheus metrics on at /metrics, e.g. 127.0.0.1:9090; off when empty", false},
+		{"base-url", (*stringValue)(&cfg.BaseUrl), "URL of the site for links in emails, e.g. https://pythia.example.org", false},
+		{"data", (*stringValue)(&cfg.DataDir), "data directory", false},
+		{"templates", (*stringValue)(&cfg.TemplatesDir), "templates directory", false},
+		{"static", (*stringValue)(&cfg.StaticDir), "directory served under /static/", false},
+		{"verify-interval", (*durationValue)(&cfg.VerifyInterval),
+			"how long a published answer goes before it is due to be checked again", false},
+		{"trash-retention", (*durationValue)(&cfg.TrashRetention),
+			"permanently delete items this long after they go in the trash (0 keeps them forever)", false},
+
+		{"read-header-timeout", (*durationValue)(&cfg.Http.ReadHeaderTimeout), "how long a client gets to send request headers", false},
+		{"read-timeout", (*durationValue)(&cfg.Http.ReadTimeout), "how long a client gets to send a whole request", false},
+		{"write-timeout", (*durationValue)(&cfg.Http.WriteTimeout), "how long the server gets to send a response", false},
+		{"idle-timeout", (*durationValue)(&cfg.Http.IdleTimeout), "how long an idle keep-alive connection stays open", false},
+		{"shutdown-timeout", (*durationValue)(&cfg.Http.ShutdownTimeout),
+			"how long requests in progress get to finish on SIGINT or SIGTERM", false},
+		{"trusted-proxies", (*stringValue)(&cfg.Http.TrustedProxies),
+			"reverse proxies whose X-Forwarded-For is believed, e.g. \"127.0.0.1, 10.0.0.0/8\"", false},
+
+		{"session-keys", (*stringValue)(&cfg.Session.KeysFile), "file holding the session cookie keys, newest first", false},
+		{"session-secret", (*stringValue)(&cfg.Session.Keys),
+			"session cookie keys, newest first and separated by commas, instead of -session-keys", true},
+		{"session-idle-timeout", (*durationValue)(&cfg.Session.IdleTimeout), "log out sessions unused for this long", false},
+		{"session-max-age", (*durationValue)(&cfg.Session.MaxAge), "log out sessions this old regardless of use", false},
+		{"cookie-secure", (*boolValue)(&cfg.Session.CookieSecure),
+			"only send cookies over HTTPS, e.g. behind a proxy that does TLS (always on with -tls-cert)", false},
+		{"cookie-domain", (*stringValue)(&cfg.Session.CookieDomain), "domain for cookies (the site's host when empty)", false},
+		{"cookie-samesite", (*stringValue)(&cfg.Session.CookieSameSite), "SameSite for the session cookie: lax, strict or none", false},
+
+		{"tls-cert", (*stringValue)(&cfg.Tls.CertFile), "PEM certificate file; serves HTTPS along with -tls-key", false},
+		{"tls-key", (*stringValue)(&cfg.Tls.KeyFile), "PEM private key file for -tls-cert", false},
+		{"tls-redirect-from", (*stringValue)(&cfg.Tls.RedirectFrom),
+			"also listen for plain HTTP here, e.g. :80, and redirect it to HTTPS", false},
+		{"hsts-max-age", (*durationValue)(&cfg.Tls.HstsMaxAge),
+			"how long browsers should only use HTTPS for the site, when serving HTTPS (0 sends no HSTS header)", false},
+		{"hsts-include-subdomains", (*boolValue)(&cfg.Tls.HstsIncludeSubdomains), "make HSTS cover subdomains too", false},
+
+		{"log-level", (*stringValue)(&cfg.Log.Level), "debug, info, warn or error", false},
+		{"log-format", (*stringValue)(&cfg.Log.Format), "text or json", false},
+
+		{"require-admin-2fa", (*boolValue)(&cfg.Features.RequireAdminTwoFactor),
+			"require two-factor authentication for admin accounts", false},
+		{"api", (*boolValue)(&cfg.Features.Api), "serve the JSON API under /api/", false},
+
+		{"oidc-name", (*stringValue)(&cfg.Oidc.Name), "label for the single sign-on login button", false},
+		{"oidc-issuer", (*stringValue)(&cfg.Oidc.IssuerUrl), "OpenID Connect issuer URL; single sign-on is off when empty", false},
+		{"oidc-client-id", (*stringValue)(&cfg.Oidc.ClientId), "OpenID Connect client id", false},
+		{"oidc-client-secret", (*stringValue)(&cfg.Oidc.ClientSecret), "OpenID Connect client secret", true},
+		{"oidc-redirect-url", (*stringValue)(&cfg.Oidc.RedirectUrl), "URL of /logins/oidc/callback as registered with the provider", false},
+		{"oidc-groups-claim", (*stringValue)(&cfg.Oidc.GroupsClaim), "ID token claim listing the user's groups", false},
+		{"oidc-role-map", (*stringValue)(&cfg.Oidc.RoleMap),
+			"map provider groups to levels, e.g. \"pythia-admins=admin,pythia-editors=editor\"", false},
+
+		{"ldap-url", (*stringValue)(&cfg.Ldap.Url), "LDAP server, e.g. ldaps://ldap.example.org; LDAP logins are off when empty", false},
+		{"ldap-starttls", (*boolValue)(&cfg.Ldap.StartTls), "upgrade an ldap:// connection with StartTLS", false},
+		{"ldap-ca-file", (*stringValue)(&cfg.Ldap.CaFile), "PEM file of CA certificates to trust for the LDAP server", false},
+		{"ldap-insecure-skip-verify", (*boolValue)(&cfg.Ldap.InsecureSkipVerify), "don't verify the LDAP server's certificate", false},
+		{"ldap-bind-dn", (*stringValue)(&cfg.Ldap.BindDn), "DN to bind as when looking users up (anonymous when empty)", false},
+		{"ldap-bind-password", (*stringValue)(&cfg.Ldap.BindPassword), "password for -ldap-bind-dn", true},
+		{"ldap-base-dn", (*stringValue)(&cfg.Ldap.BaseDn), "DN to search for users under", false},
+		{"ldap-user-filter", (*stringValue)(&cfg.Ldap.UserFilter), "search filter for a login, %s is the login", false},
+		{"ldap-login-attribute", (*stringValue)(&cfg.Ldap.LoginAttribute), "attribute holding the login", false},
+		{"ldap-name-attribute", (*stringValue)(&cfg.Ldap.NameAttribute), "attribute holding the user's name", false},
+		{"ldap-email-attribute", (*stringValue)(&cfg.Ldap.EmailAttribute), "attribute holding the user's email", false},
+		{"ldap-group-attribute", (*stringValue)(&cfg.Ldap.GroupAttribute), "attribute listing the user's group DNs", false},
+		{"ldap-role-map", (*stringValue)(&cfg.Ldap.RoleMap),
+			"map group DNs to levels, separated by \";\", e.g. \"cn=admins,ou=groups,dc=example,dc=org=admin\"", false},
+
+		{"smtp-addr", (*stringValue)(&cfg.Mail.SmtpAddr),
+			"SMTP server as host:port; emails are off when this and -mail-outbox are empty", false},
+		{"smtp-username", (*stringValue)(&cfg.Mail.SmtpUsername), "SMTP user name (no authentication when empty)", false},
+		{"smtp-password", (*stringValue)(&cfg.Mail.SmtpPassword), "SMTP password", true},
+		{"mail-from", (*stringValue)(&cfg.Mail.From), "From address for notification emails", false},
+		{"mail-outbox", (*stringValue)(&cfg.Mail.Outbox), "write emails to this directory instead of sending them, or - for the log", false},
+
+		{"chat-signing-secret", (*stringValue)(&cfg.Chat.SigningSecret), "Slack signing secret for /chat/command", true},
+		{"chat-token", (*stringValue)(&cfg.Chat.Token), "Mattermost slash command token for /chat/command", true},
+	}
+}
+
+func envName(flagName string) string {
+	return "PYTHIA_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+type stringValue string
+
+func (s *stringValue) Set(v string) error {
+	*s = stringValue(v)
+	return nil
+}
+
+func (s *stringValue) String() string { return string(*s) }
+
+type boolValue bool
+
+func (b *boolValue) Set(v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+
+	*b = boolValue(parsed)
+
+	return nil
+}
+
+func (b *boolValue) String() string { return strconv.FormatBool(bool(*b)) }
+
+// IsBoolFlag lets a bool be given as a bare -flag.
+func (b *boolValue) IsBoolFlag() bool { return true }
+
+type durationValue time.Duration
+
+func (d *durationValue) Set(v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+
+	*d = durationValue(parsed)
+
+	return nil
+}
+
+func (d *durationValue) String() string { return time.Duration(*d).String() }
@@ -0,0 +1,64 @@
+// Package data_lock keeps the server and the admin and command-line tools
+// from changing the same data directory at once.  ivy keeps its indexes in
+// memory, so a record written behind a running server's back isn't seen by
+// it, and the two can overwrite each other's changes.
+package data_lock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// FileName is the lock file's name in the data directory.
+const FileName = "pythia.lock"
+
+var ErrLocked = errors.New("the data directory is in use")
+
+type Lock struct {
+	file *os.File
+}
+
+// Acquire locks dataDir, or returns an error wrapping ErrLocked, naming the
+// process that has it, if another process already does.  The lock is
+// released by Release or when the process exits, however it exits, so a
+// crashed server never leaves the directory locked.
+func Acquire(dataDir string) (*Lock, error) {
+	path := filepath.Join(dataDir, FileName)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		pid, _ := os.ReadFile(path)
+		f.Close()
+
+		return nil, fmt.Errorf("%w by process %v", ErrLocked, strings.TrimSpace(string(pid)))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Lock{file: f}, nil
+}
+
+func (l *Lock) Release() {
+	l.file.Close()
+}
@@ -0,0 +1,29 @@
+package data_lock
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAcquire(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := Acquire(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Acquire(dir)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second lock: got %v, want ErrLocked", err)
+	}
+
+	lock.Release()
+
+	lock, err = Acquire(dir)
+	if err != nil {
+		t.Fatalf("lock not given up by Release: %v", err)
+	}
+
+	lock.Release()
+}
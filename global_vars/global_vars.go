@@ -1,11 +1,37 @@
 package global_vars
 
 import (
-	"github.com/gorilla/sessions"
 	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/authenticators"
+	"github.com/jameycribbs/pythia/challenge"
+	"github.com/jameycribbs/pythia/login_throttle"
+	"github.com/jameycribbs/pythia/notify"
+	"github.com/jameycribbs/pythia/oidc_auth"
+	"github.com/jameycribbs/pythia/record_lock"
+	"github.com/jameycribbs/pythia/session_store"
+	"github.com/jameycribbs/pythia/stale"
+	"github.com/jameycribbs/pythia/webhooks"
+	"time"
 )
 
 type GlobalVars struct {
-	MyDB         *ivy.DB
-	SessionStore *sessions.CookieStore
+	MyDB          *ivy.DB
+	Locks         *record_lock.Locks
+	SessionStore  *session_store.Store
+	LoginThrottle *login_throttle.Throttle
+	IpThrottle    *login_throttle.Throttle
+	Authenticator authenticators.Authenticator
+	Oidc          *oidc_auth.Provider
+
+	QuestionThrottle *login_throttle.Throttle
+	Challenge        *challenge.Challenge
+	Stale            *stale.Tracker
+	Notifier         *notify.Notifier
+	Webhooks         *webhooks.Dispatcher
+
+	TemplatesDir          string
+	RequireAdminTwoFactor bool
+	TrashRetention        time.Duration
+	ChatSigningSecret     string
+	ChatToken             string
 }
@@ -0,0 +1,591 @@
+package accounts_handler
+
+import (
+	"encoding/base64"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/jameycribbs/pythia/totp"
+	"github.com/justinas/nosurf"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"path"
+	"strings"
+	"time"
+)
+
+type SessionRow struct {
+	Rec     *models.Session
+	Current bool
+}
+
+type TemplateData struct {
+	Msg               string
+	ErrorMsg          string
+	TwoFactorRequired bool
+	QrCode            template.URL
+	TotpSecret        string
+	RecoveryCodes     []string
+	Sessions          []SessionRow
+	Editions          []*models.Edition
+	ApiTokens         []*models.ApiToken
+	NewApiToken       string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func View(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	editions, err := models.AllEditions(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData := TemplateData{Editions: editions, CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if r.FormValue("passwordChanged") != "" {
+		templateData.Msg = "Your password has been changed."
+	}
+
+	if r.FormValue("notificationsChanged") != "" {
+		templateData.Msg = "Your email settings have been saved."
+	}
+
+	renderTemplate(w, r, gv, "view", &templateData)
+}
+
+// UpdateEdition sets which edition of the rules the user's searches are for.
+func UpdateEdition(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	edition := r.FormValue("edition")
+
+	if edition != "" {
+		var rec models.Edition
+
+		err := gv.MyDB.Find("editions", &rec, edition)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	before := *currentUser
+
+	currentUser.Edition = edition
+
+	err := gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "users",
+		TargetId: currentUser.FileId, Detail: "edition", Before: before, After: currentUser})
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+// UpdateNotifications sets the user's email address and which emails they
+// want to get.
+func UpdateNotifications(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			editions, err := models.AllEditions(gv.MyDB)
+			if err != nil {
+				request_log.ServerError(w, r, err)
+				return
+			}
+
+			templateData := TemplateData{Editions: editions, ErrorMsg: "That doesn't look like an email address",
+				CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+			renderTemplate(w, r, gv, "view", &templateData)
+			return
+		}
+	}
+
+	before := *currentUser
+
+	currentUser.Email = email
+	currentUser.Notify = models.NotificationPrefs{
+		Questions:  r.FormValue("notifyQuestions") == "on",
+		Reviews:    r.FormValue("notifyReviews") == "on",
+		OwnAnswers: r.FormValue("notifyOwnAnswers") == "on",
+		Digest:     r.FormValue("notifyDigest") == "on",
+	}
+
+	err := gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "users",
+		TargetId: currentUser.FileId, Detail: "notifications", Before: before, After: currentUser})
+
+	http.Redirect(w, r, "/account?notificationsChanged=1", http.StatusFound)
+}
+
+func EditPassword(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "password", &templateData)
+}
+
+func UpdatePassword(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	currentPassword := r.FormValue("currentPassword")
+	newPassword := r.FormValue("newPassword")
+	confirmPassword := r.FormValue("confirmPassword")
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if !currentUser.PasswordMatches(currentPassword) {
+		templateData.ErrorMsg = "Current password is incorrect"
+		renderTemplate(w, r, gv, "password", &templateData)
+		return
+	}
+
+	err := models.ValidateNewPassword(newPassword, confirmPassword)
+	if err != nil {
+		templateData.ErrorMsg = err.Error()
+		renderTemplate(w, r, gv, "password", &templateData)
+		return
+	}
+
+	err = currentUser.SetPassword(newPassword)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	err = gv.SessionStore.RevokeUser(currentUser.FileId, session.ID)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = models.RevokeUserApiTokens(gv.MyDB, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "password_changed", Collection: "users",
+		TargetId: currentUser.FileId})
+
+	http.Redirect(w, r, "/account?passwordChanged=1", http.StatusFound)
+}
+
+func TwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r),
+		TwoFactorRequired: gv.RequireAdminTwoFactor && currentUser.Level == "admin"}
+
+	if currentUser.TotpEnabled {
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	err := startEnrollment(w, r, gv, currentUser, &templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	renderTemplate(w, r, gv, "two_factor", &templateData)
+}
+
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	secret, _ := session.Values["pending_totp_secret"].(string)
+	if secret == "" || currentUser.TotpEnabled {
+		http.Redirect(w, r, "/account/two_factor", http.StatusFound)
+		return
+	}
+
+	step, ok := totp.Validate(secret, r.FormValue("code"), time.Now())
+	if !ok {
+		templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r),
+			ErrorMsg:          "That code didn't match.  Check the time on your phone and try again.",
+			TwoFactorRequired: gv.RequireAdminTwoFactor && currentUser.Level == "admin"}
+
+		err := showEnrollment(secret, currentUser, &templateData)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	codes, err := currentUser.GenerateRecoveryCodes()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	currentUser.TotpSecret = secret
+	currentUser.TotpEnabled = true
+	currentUser.TotpLastStep = step
+
+	err = gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	delete(session.Values, "pending_totp_secret")
+	session.Save(r, w)
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "two_factor_enabled", Collection: "users",
+		TargetId: currentUser.FileId})
+
+	templateData := TemplateData{CurrentUser: currentUser, RecoveryCodes: codes}
+
+	renderTemplate(w, r, gv, "recovery_codes", &templateData)
+}
+
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r),
+		TwoFactorRequired: gv.RequireAdminTwoFactor && currentUser.Level == "admin"}
+
+	if templateData.TwoFactorRequired {
+		templateData.ErrorMsg = "Two-factor authentication is required for admin accounts."
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	if !currentUser.PasswordMatches(r.FormValue("password")) {
+		templateData.ErrorMsg = "Password is incorrect"
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	currentUser.DisableTwoFactor()
+
+	err := gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "two_factor_disabled", Collection: "users",
+		TargetId: currentUser.FileId})
+
+	http.Redirect(w, r, "/account/two_factor", http.StatusFound)
+}
+
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	if !currentUser.TotpEnabled {
+		http.Redirect(w, r, "/account/two_factor", http.StatusFound)
+		return
+	}
+
+	if !currentUser.PasswordMatches(r.FormValue("password")) {
+		templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r), ErrorMsg: "Password is incorrect",
+			TwoFactorRequired: gv.RequireAdminTwoFactor && currentUser.Level == "admin"}
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	codes, err := currentUser.GenerateRecoveryCodes()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = gv.MyDB.Update("users", currentUser, currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "recovery_codes_regenerated", Collection: "users",
+		TargetId: currentUser.FileId})
+
+	templateData := TemplateData{CurrentUser: currentUser, RecoveryCodes: codes}
+
+	renderTemplate(w, r, gv, "recovery_codes", &templateData)
+}
+
+func Sessions(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	recs, err := gv.SessionStore.UserSessions(currentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	for _, rec := range recs {
+		templateData.Sessions = append(templateData.Sessions,
+			SessionRow{Rec: rec, Current: gv.SessionStore.IsCurrent(session, rec)})
+	}
+
+	renderTemplate(w, r, gv, "sessions", &templateData)
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Session
+
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("sessions", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.UserId != currentUser.FileId {
+		http.Error(w, "Not your session", http.StatusForbidden)
+		return
+	}
+
+	err = gv.SessionStore.Revoke(fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "session_revoked", Collection: "sessions",
+		TargetId: fileId})
+
+	http.Redirect(w, r, "/account/sessions", http.StatusFound)
+}
+
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	err := gv.SessionStore.RevokeUser(currentUser.FileId, session.ID)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "other_sessions_revoked", Collection: "sessions"})
+
+	http.Redirect(w, r, "/account/sessions", http.StatusFound)
+}
+
+// ApiTokens lists the user's tokens for the JSON API.
+func ApiTokens(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	renderApiTokens(w, r, gv, &templateData)
+}
+
+// CreateApiToken makes a new API token and shows it, the only time it can be
+// seen.
+func CreateApiToken(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if name == "" {
+		templateData.ErrorMsg = "Please name the token after where it will be used"
+		renderApiTokens(w, r, gv, &templateData)
+		return
+	}
+
+	token, tokenHash, err := models.NewResetToken()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	rec := models.ApiToken{UserId: currentUser.FileId, Name: name, TokenHash: tokenHash, CreatedAt: time.Now()}
+
+	fileId, err := gv.MyDB.Create("api_tokens", rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "api_tokens",
+		TargetId: fileId, Detail: name})
+
+	templateData.NewApiToken = token
+
+	renderApiTokens(w, r, gv, &templateData)
+}
+
+func RevokeApiToken(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.ApiToken
+
+	if currentUser == nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("api_tokens", &rec, fileId)
+	if err != nil || rec.UserId != currentUser.FileId {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = gv.MyDB.Delete("api_tokens", fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "delete", Collection: "api_tokens",
+		TargetId: fileId, Detail: rec.Name})
+
+	http.Redirect(w, r, "/account/api_tokens", http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// startEnrollment keeps the secret being enrolled in the session until the
+// user proves their authenticator has it, so abandoning enrollment half way
+// leaves the account untouched.
+func startEnrollment(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, currentUser *models.User,
+	templateData *TemplateData) error {
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	secret, _ := session.Values["pending_totp_secret"].(string)
+	if secret == "" {
+		var err error
+
+		secret, err = totp.GenerateSecret()
+		if err != nil {
+			return err
+		}
+
+		session.Values["pending_totp_secret"] = secret
+
+		err = session.Save(r, w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return showEnrollment(secret, currentUser, templateData)
+}
+
+func showEnrollment(secret string, currentUser *models.User, templateData *TemplateData) error {
+	png, err := qrcode.Encode(totp.ProvisioningUri("Pythia", currentUser.Login, secret), qrcode.Medium, 256)
+	if err != nil {
+		return err
+	}
+
+	templateData.TotpSecret = secret
+	templateData.QrCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+
+	return nil
+}
+
+func renderApiTokens(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateData *TemplateData) {
+	var err error
+
+	templateData.ApiTokens, err = models.UserApiTokens(gv.MyDB, templateData.CurrentUser.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	renderTemplate(w, r, gv, "api_tokens", templateData)
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "accounts", templateName+".html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
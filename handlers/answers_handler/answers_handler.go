@@ -2,19 +2,36 @@ package answers_handler
 
 import (
 	"fmt"
+	"github.com/gorilla/sessions"
+	"github.com/jameycribbs/pythia/audit"
 	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/metrics"
 	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
 	"github.com/justinas/nosurf"
 	"html/template"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// defaultMinVotes is how many votes an answer needs before the low score
+// report will judge it.
+const defaultMinVotes = 5
+
+// needsReview is the review page tab for answers flagged by a new edition.
+const needsReview = "needs-review"
+
 type IndexTemplateData struct {
 	SearchTagsString  string
 	Answers           []*models.Answer
+	Votes             map[string]string
+	CommentCounts     map[string]int
+	EditionNames      map[string]string
 	CurrentUser       *models.User
 	DontShowLoginLink bool
 	CurrentUserAdmin  bool
@@ -23,13 +40,57 @@ type IndexTemplateData struct {
 
 type TemplateData struct {
 	Rec               *models.Answer
+	Comments          []*CommentNode
+	CanEdit           bool
+	CanReview         bool
+	ErrorMsg          string
+	SourceTypes       []models.SourceType
+	ConfidenceLevels  []string
+	Editions          []*models.Edition
+	EditionNames      map[string]string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+// CommentNode is a comment along with its replies and what the current user
+// may do with it.
+type CommentNode struct {
+	Comment     *models.Comment
+	Replies     []*CommentNode
+	CanEdit     bool
+	CanModerate bool
+	CsrfToken   string
+}
+
+type LowScoresTemplateData struct {
+	MinVotes          int
+	Answers           []*models.Answer
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+type StaleTemplateData struct {
+	Answers           []*models.Answer
+	DefaultInterval   time.Duration
+	DefaultDays       int
+	RefreshedAt       time.Time
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+type ReviewTemplateData struct {
+	Status            string
+	Statuses          []string
+	Answers           []*models.Answer
 	CurrentUser       *models.User
 	DontShowLoginLink bool
 	CsrfToken         string
 }
 
 func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_vars.GlobalVars, currentUser *models.User) {
-	var ids []string
 	var err error
 
 	funcMap := template.FuncMap{
@@ -54,50 +115,101 @@ func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_
 	if r.FormValue("searchTags") != "" {
 		templateData.SearchTagsString = r.FormValue("searchTags")
 
-		if r.FormValue("searchTags") == "all" {
-			ids, err = gv.MyDB.FindAllIds("answers")
-		} else {
-			ids, err = gv.MyDB.FindAllIdsForTags("answers", strings.Split(templateData.SearchTagsString, " "))
-		}
-
+		templateData.Answers, err = Search(gv, templateData.SearchTagsString, currentUser)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			request_log.ServerError(w, r, err)
 			return
 		}
 
-		for _, id := range ids {
-			answer := models.Answer{}
+		metrics.Search("web", len(templateData.Answers))
 
-			err = gv.MyDB.Find("answers", &answer, id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		session, _ := gv.SessionStore.Get(r, "pythia")
+		templateData.Votes = sessionVotes(session)
 
-			templateData.Answers = append(templateData.Answers, &answer)
+		templateData.CommentCounts, err = models.CommentCounts(gv.MyDB)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		editions, err := models.AllEditions(gv.MyDB)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
 		}
+
+		templateData.EditionNames = models.EditionNames(editions)
 	}
 
 	templateData.CsrfToken = nosurf.Token(r)
 
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "answers", "index.html")
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "answers", "index.html")
 
 	tmpl := template.New("idx").Funcs(funcMap)
 
 	tmpl, err = tmpl.ParseFiles(lp, fp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
 	err = tmpl.ExecuteTemplate(w, "layout", templateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 }
 
+// Search finds the answers matching search that user may see, best match
+// first.  Every tag in search must match; "source:<type>" terms narrow the
+// results to those source types and "all" on its own matches every answer.
+// user may be nil for a visitor.
+func Search(gv *global_vars.GlobalVars, search string, user *models.User) ([]*models.Answer, error) {
+	var answers []*models.Answer
+	var ids []string
+	var err error
+
+	searchTags, sources := parseSearch(search)
+
+	if len(searchTags) == 0 {
+		ids, err = gv.MyDB.FindAllIds("answers")
+	} else {
+		ids, err = gv.MyDB.FindAllIdsForTags("answers", searchTags)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		err = gv.MyDB.Find("answers", &answer, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if answer.IsDeleted() || !showInSearch(&answer, user) {
+			continue
+		}
+
+		if len(sources) > 0 && !sources[answer.Source.Type] {
+			continue
+		}
+
+		if user != nil && !answer.AppliesTo(user.Edition) {
+			continue
+		}
+
+		answers = append(answers, &answer)
+	}
+
+	rankAnswers(answers, searchTags)
+
+	return answers, nil
+}
+
 func View(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
 	if currentUser == nil {
 		http.Redirect(w, r, "/answers", http.StatusFound)
@@ -108,13 +220,35 @@ func View(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars
 
 	err := gv.MyDB.Find("answers", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() || !rec.VisibleTo(currentUser) {
+		http.NotFound(w, r)
+		return
+	}
+
+	comments, err := models.AnswerComments(gv.MyDB, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CanEdit: rec.EditableBy(currentUser),
+		CanReview: currentUser.CanReview(), CsrfToken: nosurf.Token(r)}
+
+	templateData.Comments = commentThread(comments, "", currentUser, templateData.CsrfToken)
+
+	editions, err := models.AllEditions(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
 		return
 	}
 
-	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec}
+	templateData.EditionNames = models.EditionNames(editions)
 
-	renderTemplate(w, "view", &templateData)
+	renderTemplate(w, r, gv, "view", &templateData)
 }
 
 func New(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -123,9 +257,10 @@ func New(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_va
 		return
 	}
 
-	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+	templateData := TemplateData{Rec: &models.Answer{}, CurrentUser: currentUser, CanReview: currentUser.CanReview(),
+		CsrfToken: nosurf.Token(r)}
 
-	renderTemplate(w, "new", &templateData)
+	renderForm(w, r, gv, "new", &templateData)
 }
 
 func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -138,12 +273,39 @@ func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global
 	answer := r.FormValue("answer")
 	tags := r.FormValue("tags")
 
-	rec := models.Answer{Question: question, Answer: answer, Tags: strings.Split(tags, " "), CreatedById: currentUser.FileId,
-		CreatedAt: time.Now(), UpdatedById: currentUser.FileId, UpdatedAt: time.Now()}
+	status := models.InitialStatus(r.FormValue("status"), currentUser)
+
+	rec := models.Answer{Question: question, Answer: answer, Tags: strings.Split(tags, " "), Status: status,
+		CreatedById: currentUser.FileId, CreatedAt: time.Now(), UpdatedById: currentUser.FileId, UpdatedAt: time.Now()}
+
+	err := rec.SetSource(r.FormValue("sourceType"), r.FormValue("sourceReference"), r.FormValue("sourceUrl"),
+		r.FormValue("sourceDate"), r.FormValue("confidence"))
+	if err != nil {
+		templateData := TemplateData{Rec: &rec, ErrorMsg: err.Error(), CurrentUser: currentUser,
+			CanReview: currentUser.CanReview(), CsrfToken: nosurf.Token(r)}
+		renderForm(w, r, gv, "new", &templateData)
+		return
+	}
+
+	rec.Rules = strings.Fields(r.FormValue("rules"))
+	rec.Editions = r.Form["editions"]
+	rec.VerifyEvery = verifyEvery(r)
 
 	fileId, err := gv.MyDB.Create("answers", rec)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "answers", TargetId: fileId,
+		After: rec})
+
+	gv.Webhooks.Fire("answer.created", fileId, rec)
+
+	if rec.Status == models.StatusPending {
+		rec.FileId = fileId
+		gv.Notifier.Notify(currentUser, "answer_submitted",
+			gv.Notifier.Subscribers((*models.User).WantsReviewEmails), &rec)
 	}
 
 	http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
@@ -157,31 +319,25 @@ func Edit(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars
 
 	var rec models.Answer
 
-	funcMap := template.FuncMap{
-		"tagsString": func(tags []string) string {
-			return strings.Join(tags, " ")
-		}}
-
 	err := gv.MyDB.Find("answers", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
-	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
-
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "answers", "edit.html")
-
-	tmpl := template.New("edt").Funcs(funcMap)
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
 
-	tmpl, err = tmpl.ParseFiles(lp, fp)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
 		return
 	}
 
-	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
+
+	renderForm(w, r, gv, "edit", &templateData)
 }
 
 func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -197,21 +353,58 @@ func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global
 	answer := r.FormValue("answer")
 	tags := r.FormValue("tags")
 
+	defer gv.Locks.Lock("answers", fileId)()
+
 	err := gv.MyDB.Find("answers", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
+		return
+	}
+
+	before := rec
+
+	rec.Question = question
+	rec.Answer = answer
+	rec.Tags = strings.Split(tags, " ")
+	rec.UpdatedById = currentUser.FileId
+	rec.UpdatedAt = time.Now()
+
+	err = rec.SetSource(r.FormValue("sourceType"), r.FormValue("sourceReference"), r.FormValue("sourceUrl"),
+		r.FormValue("sourceDate"), r.FormValue("confidence"))
+	if err != nil {
+		templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, ErrorMsg: err.Error(), CsrfToken: nosurf.Token(r)}
+		renderForm(w, r, gv, "edit", &templateData)
 		return
 	}
 
-	rec = models.Answer{FileId: fileId, Question: question, Answer: answer, Tags: strings.Split(tags, " "),
-		UpdatedById: currentUser.FileId, UpdatedAt: time.Now(), CreatedById: rec.CreatedById, CreatedAt: rec.CreatedAt}
+	rec.Rules = strings.Fields(r.FormValue("rules"))
+	rec.Editions = r.Form["editions"]
+	rec.VerifyEvery = verifyEvery(r)
 
 	err = gv.MyDB.Update("answers", rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "answers", TargetId: fileId,
+		Before: before, After: rec})
+
+	gv.Webhooks.Fire("answer.updated", fileId, rec)
+
+	gv.Notifier.Notify(currentUser, "answer_changed",
+		[]*models.User{gv.Notifier.User(rec.CreatedById, (*models.User).WantsOwnAnswerEmails)}, &rec)
+
 	http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
 }
 
@@ -225,12 +418,22 @@ func Delete(w http.ResponseWriter, r *http.Request, fileId string, gv *global_va
 
 	err := gv.MyDB.Find("answers", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
 		return
 	}
 
 	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
-	renderTemplate(w, "delete", &templateData)
+	renderTemplate(w, r, gv, "delete", &templateData)
 }
 
 func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -239,28 +442,586 @@ func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *globa
 		return
 	}
 
+	var rec models.Answer
+
 	fileId := r.FormValue("fileId")
 
-	err := gv.MyDB.Delete("answers", fileId)
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
+		return
+	}
+
+	before := rec
+
+	rec.MoveToTrash(currentUser.FileId)
+
+	err = gv.MyDB.Update("answers", rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "delete", Collection: "answers", TargetId: fileId,
+		Before: before, After: rec})
+
+	gv.Webhooks.Fire("answer.deleted", fileId, rec)
+
 	http.Redirect(w, r, "/answers", http.StatusFound)
 }
 
+// Vote records whether an answer helped.  Each browser session gets one vote
+// per answer, which it can change its mind about.
+func Vote(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Answer
+
+	fileId := r.FormValue("fileId")
+	vote := r.FormValue("helped")
+	searchTags := r.FormValue("searchTags")
+
+	// Popular answers get votes from many visitors at once, and an editor may
+	// be saving the answer too; each has to see the others' changes.
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() || rec.Status != models.StatusPublished || (vote != "yes" && vote != "no") {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+	votes := sessionVotes(session)
+
+	if votes[fileId] != vote {
+		switch votes[fileId] {
+		case "yes":
+			rec.HelpedCount--
+		case "no":
+			rec.UnhelpedCount--
+		}
+
+		if vote == "yes" {
+			rec.HelpedCount++
+		} else {
+			rec.UnhelpedCount++
+		}
+
+		err = gv.MyDB.Update("answers", rec, fileId)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		votes[fileId] = vote
+		session.Values["votes"] = formatVotes(votes)
+		session.Save(r, w)
+	}
+
+	http.Redirect(w, r, "/answers?searchTags="+url.QueryEscape(searchTags)+"#heading"+fileId, http.StatusFound)
+}
+
+// LowScores lists the published answers that most voters said didn't help,
+// worst first, so editors know what to rewrite.
+func LowScores(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	templateData := LowScoresTemplateData{MinVotes: defaultMinVotes, CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if minVotes, err := strconv.Atoi(r.FormValue("minVotes")); err == nil && minVotes > 0 {
+		templateData.MinVotes = minVotes
+	}
+
+	ids, err := gv.MyDB.FindAllIds("answers")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		err = gv.MyDB.Find("answers", &answer, id)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		if answer.IsDeleted() || answer.Status != models.StatusPublished || answer.VoteCount() < templateData.MinVotes ||
+			answer.HelpedCount*2 >= answer.VoteCount() {
+			continue
+		}
+
+		templateData.Answers = append(templateData.Answers, &answer)
+	}
+
+	sort.SliceStable(templateData.Answers, func(i, j int) bool {
+		return templateData.Answers[i].HelpfulnessScore() < templateData.Answers[j].HelpfulnessScore()
+	})
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "answers", "low_scores.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+// Review lists the answers in one status for reviewers, waiting for review by
+// default.
+func Review(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	templateData := ReviewTemplateData{Status: r.FormValue("status"), CurrentUser: currentUser, CsrfToken: nosurf.Token(r),
+		Statuses: []string{models.StatusPending, models.StatusDraft, models.StatusArchived, needsReview}}
+
+	if templateData.Status == "" {
+		templateData.Status = models.StatusPending
+	}
+
+	ids, err := gv.MyDB.FindAllIds("answers")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		err = gv.MyDB.Find("answers", &answer, id)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		if answer.IsDeleted() {
+			continue
+		}
+
+		if templateData.Status == needsReview {
+			if !answer.NeedsReview {
+				continue
+			}
+		} else if answer.Status != templateData.Status {
+			continue
+		}
+
+		templateData.Answers = append(templateData.Answers, &answer)
+	}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "answers", "review.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+// Stale is the queue of published answers that are due to be checked again.
+func Stale(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	answers, err := gv.Stale.Overdue()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData := StaleTemplateData{Answers: answers, DefaultInterval: gv.Stale.DefaultInterval,
+		DefaultDays: int(gv.Stale.DefaultInterval.Hours() / 24), RefreshedAt: gv.Stale.RefreshedAt(),
+		CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "answers", "stale.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+// Verify records that a reviewer has checked an answer and it is still right.
+func Verify(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Answer
+
+	fileId := r.FormValue("fileId")
+
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := rec
+
+	rec.VerifiedAt = time.Now()
+	rec.VerifiedById = currentUser.FileId
+
+	err = gv.MyDB.Update("answers", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "verify", Collection: "answers", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, "/answers/stale", http.StatusFound)
+}
+
+// ClearReviewFlag records that a reviewer has checked a flagged answer against
+// the edition that flagged it.
+func ClearReviewFlag(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Answer
+
+	fileId := r.FormValue("fileId")
+
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := rec
+
+	rec.NeedsReview = false
+	rec.ReviewReason = ""
+
+	err = gv.MyDB.Update("answers", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "clear_flag", Collection: "answers", TargetId: fileId,
+		Detail: before.ReviewReason, Before: before, After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
+}
+
+// Submit sends a draft off to the reviewers.
+func Submit(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	changeStatus(w, r, gv, currentUser, "submit", models.StatusPending, false, models.StatusDraft)
+}
+
+// Approve publishes an answer.  Reviewers can also use it to bring back an
+// archived answer or to publish a draft of their own.
+func Approve(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	changeStatus(w, r, gv, currentUser, "approve", models.StatusPublished, true, models.StatusPending,
+		models.StatusDraft, models.StatusArchived)
+}
+
+// Reject sends an answer back to its author as a draft.  The comment is
+// required so the author knows what to fix.
+func Reject(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	changeStatus(w, r, gv, currentUser, "reject", models.StatusDraft, true, models.StatusPending)
+}
+
+// Archive takes a published answer out of the search results without
+// deleting it.
+func Archive(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	changeStatus(w, r, gv, currentUser, "archive", models.StatusArchived, true, models.StatusPublished)
+}
+
 //=============================================================================
 // Helper Functions
 //=============================================================================
-func renderTemplate(w http.ResponseWriter, templateName string, templateData *TemplateData) {
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "answers", templateName+".html")
+// commentThread builds the replies to parentId, or the top level comments if
+// it is empty.  Deleted comments are only kept as placeholders for their
+// replies.
+func commentThread(comments []*models.Comment, parentId string, currentUser *models.User, csrfToken string) []*CommentNode {
+	var nodes []*CommentNode
 
-	tmpl, _ := template.ParseFiles(lp, fp)
+	for _, comment := range comments {
+		if comment.ParentId != parentId {
+			continue
+		}
+
+		node := &CommentNode{Comment: comment, Replies: commentThread(comments, comment.FileId, currentUser, csrfToken),
+			CanEdit: comment.EditableBy(currentUser), CanModerate: currentUser.Level == "admin", CsrfToken: csrfToken}
+
+		if comment.IsDeleted() && len(node.Replies) == 0 {
+			continue
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// parseSearch splits a search into the tags to look for and the source types
+// to limit the results to, given as e.g. "source:errata".  "all" on its own
+// matches every answer.
+func parseSearch(search string) ([]string, map[string]bool) {
+	var tags []string
+
+	sources := make(map[string]bool)
+
+	for _, term := range strings.Fields(search) {
+		switch {
+		case strings.HasPrefix(term, "source:"):
+			sources[strings.TrimPrefix(term, "source:")] = true
+		case term != "all":
+			tags = append(tags, term)
+		}
+	}
+
+	return tags, sources
+}
+
+// verifyEvery reads the answer's own review interval in days from the form.
+// Anything other than a positive number means the default interval.
+func verifyEvery(r *http.Request) int {
+	days, err := strconv.Atoi(strings.TrimSpace(r.FormValue("verifyEvery")))
+	if err != nil || days < 0 {
+		return 0
+	}
+
+	return days
+}
+
+// rankAnswers puts the answers that match the search most closely first,
+// i.e. those with the fewest tags that weren't searched for.  Votes break ties.
+func rankAnswers(answers []*models.Answer, searchTags []string) {
+	searched := make(map[string]bool)
+
+	for _, tag := range searchTags {
+		searched[tag] = true
+	}
+
+	extraTags := func(answer *models.Answer) int {
+		extra := 0
+
+		for _, tag := range answer.Tags {
+			if !searched[tag] {
+				extra++
+			}
+		}
+
+		return extra
+	}
+
+	sort.SliceStable(answers, func(i, j int) bool {
+		ei, ej := extraTags(answers[i]), extraTags(answers[j])
+		if ei != ej {
+			return ei < ej
+		}
+
+		return answers[i].HelpfulnessScore() > answers[j].HelpfulnessScore()
+	})
+}
+
+// sessionVotes returns the votes cast from this session, keyed by answer id.
+// They are kept in the session as "id:yes,id:no".
+func sessionVotes(session *sessions.Session) map[string]string {
+	votes := make(map[string]string)
+
+	stored, _ := session.Values["votes"].(string)
+
+	for _, pair := range strings.Split(stored, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) == 2 {
+			votes[parts[0]] = parts[1]
+		}
+	}
+
+	return votes
+}
+
+func formatVotes(votes map[string]string) string {
+	var pairs []string
+
+	for id, vote := range votes {
+		pairs = append(pairs, id+":"+vote)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// showInSearch reports whether answer belongs in the search results for
+// user.  Everyone sees published answers and authors see their own work in
+// progress; reviewers find everything else through the review page.
+func showInSearch(answer *models.Answer, user *models.User) bool {
+	if answer.Status == models.StatusPublished {
+		return true
+	}
+
+	return user != nil && answer.CreatedById == user.FileId && answer.Status != models.StatusArchived
+}
+
+// changeStatus moves the answer named in the form to status to, provided it
+// is currently in one of the from statuses and currentUser is allowed to.
+func changeStatus(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, currentUser *models.User,
+	action string, to string, reviewersOnly bool, from ...string) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Answer
+
+	fileId := r.FormValue("fileId")
+	comment := strings.TrimSpace(r.FormValue("comment"))
+
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() || !rec.VisibleTo(currentUser) {
+		http.NotFound(w, r)
+		return
+	}
+
+	allowed := false
+
+	for _, status := range from {
+		if rec.Status == status {
+			allowed = true
+		}
+	}
+
+	if !allowed || (reviewersOnly && !currentUser.CanReview()) || !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
+		return
+	}
+
+	if action == "reject" && comment == "" {
+		templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CanEdit: true, CanReview: true,
+			ErrorMsg: "Please say why the answer is being rejected", CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "view", &templateData)
+		return
+	}
+
+	before := rec
+
+	rec.Status = to
+
+	if reviewersOnly {
+		rec.ReviewComment = comment
+		rec.ReviewedById = currentUser.FileId
+		rec.ReviewedAt = time.Now()
+	}
+
+	err = gv.MyDB.Update("answers", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: action, Collection: "answers", TargetId: fileId,
+		Detail: comment, Before: before, After: rec})
+
+	gv.Webhooks.Fire("answer.updated", fileId, rec)
+
+	switch to {
+	case models.StatusPending:
+		gv.Notifier.Notify(currentUser, "answer_submitted",
+			gv.Notifier.Subscribers((*models.User).WantsReviewEmails), &rec)
+	case models.StatusPublished, models.StatusDraft:
+		gv.Notifier.Notify(currentUser, "answer_reviewed",
+			[]*models.User{gv.Notifier.User(rec.CreatedById, (*models.User).WantsOwnAnswerEmails)}, &rec)
+	case models.StatusArchived:
+		gv.Notifier.Notify(currentUser, "answer_changed",
+			[]*models.User{gv.Notifier.User(rec.CreatedById, (*models.User).WantsOwnAnswerEmails)}, &rec)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v", fileId), http.StatusFound)
+}
+
+// renderForm shows the new or edit form along with the choices for its
+// source and edition fields.
+func renderForm(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	var err error
+
+	templateData.Editions, err = models.AllEditions(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData.SourceTypes = models.SourceTypes
+	templateData.ConfidenceLevels = models.ConfidenceLevels
+
+	renderTemplate(w, r, gv, templateName, templateData)
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "answers", templateName+".html")
+
+	funcMap := template.FuncMap{
+		"tagsString": func(tags []string) string {
+			return strings.Join(tags, " ")
+		}}
+
+	tmpl, _ := template.New(templateName).Funcs(funcMap).ParseFiles(lp, fp)
 	err := tmpl.ExecuteTemplate(w, "layout", templateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 }
@@ -0,0 +1,259 @@
+package api_handler
+
+import (
+	"encoding/json"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/handlers/answers_handler"
+	"github.com/jameycribbs/pythia/metrics"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Answer is an answer as the API returns it, with its id.
+type Answer struct {
+	Id string `json:"id"`
+	*models.Answer
+}
+
+// AnswerInput is the body of a create or update request.
+type AnswerInput struct {
+	Question string   `json:"question"`
+	Answer   string   `json:"answer"`
+	Tags     []string `json:"tags"`
+	Status   string   `json:"status"`
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// Search runs the same search as the search box.  Without a token only
+// published answers are returned.
+func Search(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	search := strings.TrimSpace(r.FormValue("search"))
+	if search == "" {
+		writeError(w, http.StatusBadRequest, "search is required")
+		return
+	}
+
+	answers, err := answers_handler.Search(gv, search, currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	metrics.Search("api", len(answers))
+
+	results := []Answer{}
+
+	for _, answer := range answers {
+		results = append(results, Answer{Id: answer.FileId, Answer: answer})
+	}
+
+	writeJson(w, http.StatusOK, results)
+}
+
+func Show(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Answer
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil || rec.IsDeleted() || !rec.VisibleTo(currentUser) {
+		writeError(w, http.StatusNotFound, "no such answer")
+		return
+	}
+
+	writeJson(w, http.StatusOK, Answer{Id: fileId, Answer: &rec})
+}
+
+func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		writeError(w, http.StatusUnauthorized, "a token is required")
+		return
+	}
+
+	input, ok := readInput(w, r)
+	if !ok {
+		return
+	}
+
+	rec := models.Answer{Question: input.Question, Answer: input.Answer, Tags: input.Tags,
+		Status: models.InitialStatus(input.Status, currentUser), CreatedById: currentUser.FileId,
+		CreatedAt: time.Now(), UpdatedById: currentUser.FileId, UpdatedAt: time.Now()}
+
+	fileId, err := gv.MyDB.Create("answers", rec)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "answers", TargetId: fileId,
+		After: rec})
+
+	gv.Webhooks.Fire("answer.created", fileId, rec)
+
+	rec.FileId = fileId
+
+	if rec.Status == models.StatusPending {
+		gv.Notifier.Notify(currentUser, "answer_submitted",
+			gv.Notifier.Subscribers((*models.User).WantsReviewEmails), &rec)
+	}
+
+	writeJson(w, http.StatusCreated, Answer{Id: fileId, Answer: &rec})
+}
+
+// Update replaces an answer's question, answer and tags.  The status is left
+// alone; it only changes through the review workflow.
+func Update(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Answer
+
+	if currentUser == nil {
+		writeError(w, http.StatusUnauthorized, "a token is required")
+		return
+	}
+
+	defer gv.Locks.Lock("answers", fileId)()
+
+	err := gv.MyDB.Find("answers", &rec, fileId)
+	if err != nil || rec.IsDeleted() || !rec.VisibleTo(currentUser) {
+		writeError(w, http.StatusNotFound, "no such answer")
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		writeError(w, http.StatusForbidden, "you may not edit this answer")
+		return
+	}
+
+	input, ok := readInput(w, r)
+	if !ok {
+		return
+	}
+
+	before := rec
+
+	rec.Question = input.Question
+	rec.Answer = input.Answer
+	rec.Tags = input.Tags
+	rec.UpdatedById = currentUser.FileId
+	rec.UpdatedAt = time.Now()
+
+	err = gv.MyDB.Update("answers", rec, fileId)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "answers", TargetId: fileId,
+		Before: before, After: rec})
+
+	gv.Webhooks.Fire("answer.updated", fileId, rec)
+
+	gv.Notifier.Notify(currentUser, "answer_changed",
+		[]*models.User{gv.Notifier.User(rec.CreatedById, (*models.User).WantsOwnAnswerEmails)}, &rec)
+
+	writeJson(w, http.StatusOK, Answer{Id: fileId, Answer: &rec})
+}
+
+// Tags lists every tag on the answers the caller can see, with how many
+// answers have it.
+func Tags(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	answers, err := answers_handler.Search(gv, "all", currentUser)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, CountTags(answers))
+}
+
+// CountTags counts the answers carrying each tag, sorted by tag.
+func CountTags(answers []*models.Answer) []TagCount {
+	counts := make(map[string]int)
+
+	for _, answer := range answers {
+		for _, tag := range answer.Tags {
+			if tag != "" {
+				counts[tag]++
+			}
+		}
+	}
+
+	tags := []TagCount{}
+
+	for tag, count := range counts {
+		tags = append(tags, TagCount{Tag: tag, Count: count})
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+
+	return tags
+}
+
+// Unauthorized is the reply to a request with a bad token.
+func Unauthorized(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, "invalid token")
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func readInput(w http.ResponseWriter, r *http.Request) (AnswerInput, bool) {
+	var input AnswerInput
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&input)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return input, false
+	}
+
+	input.Question = strings.TrimSpace(input.Question)
+	input.Answer = strings.TrimSpace(input.Answer)
+
+	if input.Question == "" || input.Answer == "" {
+		writeError(w, http.StatusBadRequest, "question and answer are required")
+		return input, false
+	}
+
+	return input, true
+}
+
+// serverError logs err against the request and answers with a 500 that
+// gives nothing about it away but the request id.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	request_log.Logger(r).Error("Request failed", "err", err)
+
+	msg := "something went wrong"
+	if id := w.Header().Get(request_log.Header); id != "" {
+		msg += " (request " + id + ")"
+	}
+
+	writeError(w, http.StatusInternalServerError, msg)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, errorBody{Error: msg})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	err := enc.Encode(v)
+	if err != nil {
+		slog.Error("Could not write API response", "err", err)
+	}
+}
@@ -0,0 +1,173 @@
+package audit_handler
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The page only shows the most recent entries; the export has them all.
+const pageLimit = 500
+
+type Filter struct {
+	Actor      string
+	Action     string
+	Collection string
+	TargetId   string
+	From       string
+	To         string
+}
+
+type IndexTemplateData struct {
+	Filter            Filter
+	Entries           []*models.AuditEntry
+	Truncated         bool
+	ExportQuery       template.URL
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+}
+
+func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	filter := filterFromRequest(r)
+
+	entries, err := findEntries(gv, filter)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData := IndexTemplateData{Filter: filter, CurrentUser: currentUser, ExportQuery: template.URL(r.URL.Query().Encode())}
+
+	if len(entries) > pageLimit {
+		entries = entries[:pageLimit]
+		templateData.Truncated = true
+	}
+
+	templateData.Entries = entries
+
+	funcMap := template.FuncMap{
+		"rawJson": func(b json.RawMessage) string {
+			return string(b)
+		}}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "audit", "index.html")
+
+	tmpl := template.New("idx").Funcs(funcMap)
+
+	tmpl, err = tmpl.ParseFiles(lp, fp)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+func Export(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	entries, err := findEntries(gv, filterFromRequest(r))
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	filename := "pythia-audit-" + time.Now().Format("20060102-150405")
+
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename+".json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "actor_id", "actor_login", "action", "collection", "target_id", "detail", "ip",
+		"before", "after"})
+
+	for _, entry := range entries {
+		cw.Write([]string{entry.FileId, entry.CreatedAt.Format(time.RFC3339), entry.ActorId, entry.ActorLogin, entry.Action,
+			entry.Collection, entry.TargetId, entry.Detail, entry.Ip, string(entry.Before), string(entry.After)})
+	}
+
+	cw.Flush()
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func filterFromRequest(r *http.Request) Filter {
+	return Filter{Actor: strings.TrimSpace(r.FormValue("actor")), Action: strings.TrimSpace(r.FormValue("action")),
+		Collection: strings.TrimSpace(r.FormValue("collection")), TargetId: strings.TrimSpace(r.FormValue("targetId")),
+		From: strings.TrimSpace(r.FormValue("from")), To: strings.TrimSpace(r.FormValue("to"))}
+}
+
+// findEntries returns the entries matching filter, newest first.
+func findEntries(gv *global_vars.GlobalVars, filter Filter) ([]*models.AuditEntry, error) {
+	var entries []*models.AuditEntry
+
+	from, _ := time.ParseInLocation("2006-01-02", filter.From, time.Local)
+	to, _ := time.ParseInLocation("2006-01-02", filter.To, time.Local)
+
+	ids, err := gv.MyDB.FindAllIds("audit")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		entry := models.AuditEntry{}
+
+		err = gv.MyDB.Find("audit", &entry, id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case filter.Actor != "" && !strings.EqualFold(entry.ActorLogin, filter.Actor) && entry.ActorId != filter.Actor:
+			continue
+		case filter.Action != "" && entry.Action != filter.Action:
+			continue
+		case filter.Collection != "" && entry.Collection != filter.Collection:
+			continue
+		case filter.TargetId != "" && entry.TargetId != filter.TargetId:
+			continue
+		case !from.IsZero() && entry.CreatedAt.Before(from):
+			continue
+		case !to.IsZero() && !entry.CreatedAt.Before(to.AddDate(0, 0, 1)):
+			continue
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.After(entries[j].CreatedAt) })
+
+	return entries, nil
+}
@@ -0,0 +1,184 @@
+package chat_handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/handlers/answers_handler"
+	"github.com/jameycribbs/pythia/metrics"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxResults    = 3
+	maxAnswerLen  = 300
+	maxRequestAge = 5 * time.Minute
+)
+
+// Response is the JSON reply Slack and Mattermost both understand.
+type Response struct {
+	ResponseType string `json:"response_type"`
+	Text         string `json:"text"`
+}
+
+// Command answers a Slack or Mattermost slash command such as
+// "/pythia rout minefield" with the best matching published answers.  Slack
+// requests are checked against the signing secret; Mattermost ones carry the
+// command's token.
+func Command(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if gv.ChatSigningSecret == "" && gv.ChatToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slack := r.Header.Get("X-Slack-Signature") != ""
+
+	if slack {
+		if !validSlackSignature(gv.ChatSigningSecret, r, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+	} else if !validToken(gv.ChatToken, form.Get("token")) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+
+	search := strings.TrimSpace(form.Get("text"))
+
+	if search == "" {
+		writeResponse(w, r, Response{ResponseType: "ephemeral",
+			Text: fmt.Sprintf("Give me some tags to look up, e.g. `%v rout minefield`.", form.Get("command"))})
+		return
+	}
+
+	answers, err := answers_handler.Search(gv, search, nil)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	metrics.Search("chat", len(answers))
+
+	moreUrl := gv.Notifier.BaseUrl + "/answers?searchTags=" + url.QueryEscape(search)
+
+	writeResponse(w, r, Response{ResponseType: "in_channel", Text: formatAnswers(search, answers, moreUrl, slack)})
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// validSlackSignature checks Slack's X-Slack-Signature, an HMAC-SHA256 of
+// "v0:<timestamp>:<body>", and that the request isn't an old one replayed.
+func validSlackSignature(secret string, r *http.Request, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > maxRequestAge || age < -maxRequestAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Slack-Signature")))
+}
+
+func validToken(expected string, token string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// formatAnswers writes the first few answers as a compact message.  Slack and
+// Mattermost disagree on bold text and links, so slack picks the dialect.
+func formatAnswers(search string, answers []*models.Answer, moreUrl string, slack bool) string {
+	var buf bytes.Buffer
+
+	bold := func(s string) string { return "**" + s + "**" }
+	link := func(text, href string) string { return "[" + text + "](" + href + ")" }
+	escape := func(s string) string { return s }
+
+	if slack {
+		bold = func(s string) string { return "*" + s + "*" }
+		link = func(text, href string) string { return "<" + href + "|" + text + ">" }
+		escape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	}
+
+	if len(answers) == 0 {
+		fmt.Fprintf(&buf, "No answers found for %v.", bold(escape(search)))
+		return buf.String()
+	}
+
+	for i, answer := range answers {
+		if i == maxResults {
+			break
+		}
+
+		fmt.Fprintf(&buf, "%v\n> %v\n", bold(escape(oneLine(answer.Question, maxAnswerLen))),
+			escape(oneLine(answer.Answer, maxAnswerLen)))
+	}
+
+	more := "Show on Pythia"
+	if len(answers) > maxResults {
+		more = fmt.Sprintf("Show all %v answers", len(answers))
+	}
+
+	buf.WriteString(link(more, moreUrl))
+
+	return buf.String()
+}
+
+// oneLine squashes s onto one line and cuts it off after max characters.
+func oneLine(s string, max int) string {
+	runes := []rune(strings.Join(strings.Fields(s), " "))
+
+	if len(runes) > max {
+		return string(runes[:max]) + "…"
+	}
+
+	return string(runes)
+}
+
+func writeResponse(w http.ResponseWriter, r *http.Request, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,246 @@
+package comments_handler
+
+import (
+	"fmt"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type TemplateData struct {
+	Rec               *models.Comment
+	ErrorMsg          string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var answer models.Answer
+
+	answerId := r.FormValue("answerId")
+	parentId := r.FormValue("parentId")
+	body := strings.TrimSpace(r.FormValue("body"))
+
+	err := gv.MyDB.Find("answers", &answer, answerId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if answer.IsDeleted() || !answer.VisibleTo(currentUser) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if parentId != "" {
+		var parent models.Comment
+
+		err = gv.MyDB.Find("comments", &parent, parentId)
+		if err != nil || parent.AnswerId != answerId || parent.IsDeleted() {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if body == "" {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v#comments", answerId), http.StatusFound)
+		return
+	}
+
+	now := time.Now()
+
+	rec := models.Comment{AnswerId: answerId, ParentId: parentId, Body: body, CreatedById: currentUser.FileId,
+		CreatedAt: now, UpdatedAt: now}
+
+	fileId, err := gv.MyDB.Create("comments", rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "comments", TargetId: fileId,
+		After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v#comment%v", answerId, fileId), http.StatusFound)
+}
+
+func Edit(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Comment
+
+	err := gv.MyDB.Find("comments", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v#comment%v", rec.AnswerId, fileId), http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{Rec: &rec, CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "edit", &templateData)
+}
+
+func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Comment
+
+	fileId := r.FormValue("fileId")
+	body := strings.TrimSpace(r.FormValue("body"))
+
+	err := gv.MyDB.Find("comments", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if !rec.EditableBy(currentUser) {
+		http.Redirect(w, r, fmt.Sprintf("/answers/%v#comment%v", rec.AnswerId, fileId), http.StatusFound)
+		return
+	}
+
+	if body == "" {
+		rec.Body = body
+
+		templateData := TemplateData{Rec: &rec, ErrorMsg: "A comment can't be empty", CurrentUser: currentUser,
+			CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	before := rec
+
+	rec.Body = body
+	rec.UpdatedAt = time.Now()
+
+	err = gv.MyDB.Update("comments", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "comments", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v#comment%v", rec.AnswerId, fileId), http.StatusFound)
+}
+
+// Hide hides a comment from everyone but admins, or shows it again.  Replies
+// to a hidden comment stay visible.
+func Hide(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	var rec models.Comment
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("comments", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	before := rec
+	action := "hide"
+
+	if rec.Hidden {
+		action = "unhide"
+		rec.Hidden = false
+		rec.HiddenById = ""
+	} else {
+		rec.Hidden = true
+		rec.HiddenById = currentUser.FileId
+	}
+
+	err = gv.MyDB.Update("comments", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: action, Collection: "comments", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v#comment%v", rec.AnswerId, fileId), http.StatusFound)
+}
+
+// Destroy moves a comment to the trash.  If it has replies it is shown as
+// deleted so the rest of the thread still makes sense.
+func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	var rec models.Comment
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("comments", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := rec
+
+	rec.MoveToTrash(currentUser.FileId)
+
+	err = gv.MyDB.Update("comments", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "delete", Collection: "comments", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v#comments", rec.AnswerId), http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "comments", templateName+".html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
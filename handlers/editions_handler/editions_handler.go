@@ -0,0 +1,179 @@
+package editions_handler
+
+import (
+	"fmt"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type TemplateData struct {
+	Editions          []*models.Edition
+	Msg               string
+	ErrorMsg          string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Index(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if flagged := r.FormValue("flagged"); flagged != "" {
+		templateData.Msg = fmt.Sprintf("The edition was added and %v answers were flagged for review.", flagged)
+	}
+
+	renderIndex(w, r, gv, &templateData)
+}
+
+// Create declares a new edition and flags every answer that cites one of the
+// rules it changed as needing review.
+func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	releasedAt := r.FormValue("releasedAt")
+	changedRules := strings.Fields(r.FormValue("changedRules"))
+
+	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if name == "" {
+		templateData.ErrorMsg = "Please give the edition a name"
+		renderIndex(w, r, gv, &templateData)
+		return
+	}
+
+	released := time.Now()
+
+	if releasedAt != "" {
+		var err error
+
+		released, err = time.Parse("2006-01-02", releasedAt)
+		if err != nil {
+			templateData.ErrorMsg = "The release date must look like 2006-01-02"
+			renderIndex(w, r, gv, &templateData)
+			return
+		}
+	}
+
+	rec := models.Edition{Name: name, ReleasedAt: released, ChangedRules: changedRules, CreatedById: currentUser.FileId,
+		CreatedAt: time.Now()}
+
+	fileId, err := gv.MyDB.Create("editions", rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "editions", TargetId: fileId,
+		After: rec})
+
+	flagged, err := flagAnswers(gv, r, currentUser, &rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/editions?flagged=%v", flagged), http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// flagAnswers marks the answers citing any of edition's changed rules as
+// needing review and returns how many it marked.
+func flagAnswers(gv *global_vars.GlobalVars, r *http.Request, currentUser *models.User, edition *models.Edition) (int, error) {
+	flagged := 0
+
+	if len(edition.ChangedRules) == 0 {
+		return 0, nil
+	}
+
+	ids, err := gv.MyDB.FindAllIds("answers")
+	if err != nil {
+		return flagged, err
+	}
+
+	for _, id := range ids {
+		ok, err := flagAnswer(gv, r, currentUser, edition, id)
+		if err != nil {
+			return flagged, err
+		}
+
+		if ok {
+			flagged++
+		}
+	}
+
+	return flagged, nil
+}
+
+// flagAnswer marks one answer as needing review if it cites any of
+// edition's changed rules, and reports whether it did.
+func flagAnswer(gv *global_vars.GlobalVars, r *http.Request, currentUser *models.User, edition *models.Edition,
+	id string) (bool, error) {
+
+	answer := models.Answer{}
+
+	defer gv.Locks.Lock("answers", id)()
+
+	err := gv.MyDB.Find("answers", &answer, id)
+	if err != nil {
+		return false, err
+	}
+
+	cited := answer.CitesAny(edition.ChangedRules)
+	if answer.IsDeleted() || len(cited) == 0 {
+		return false, nil
+	}
+
+	before := answer
+
+	answer.NeedsReview = true
+	answer.ReviewReason = fmt.Sprintf("%v changed %v", edition.Name, strings.Join(cited, ", "))
+
+	err = gv.MyDB.Update("answers", answer, id)
+	if err != nil {
+		return false, err
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "flag", Collection: "answers", TargetId: id,
+		Detail: answer.ReviewReason, Before: before, After: answer})
+
+	return true, nil
+}
+
+func renderIndex(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateData *TemplateData) {
+	var err error
+
+	templateData.Editions, err = models.AllEditions(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "editions", "index.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,65 @@
+package lockouts_handler
+
+import (
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/login_throttle"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+)
+
+type IndexTemplateData struct {
+	Logins            []login_throttle.Attempts
+	Ips               []login_throttle.Attempts
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	templateData := IndexTemplateData{Logins: gv.LoginThrottle.Entries(), Ips: gv.IpThrottle.Entries(),
+		CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "lockouts", "index.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+func Unlock(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	key := r.FormValue("key")
+
+	switch kind {
+	case "login":
+		gv.LoginThrottle.Unlock(key)
+	case "ip":
+		gv.IpThrottle.Unlock(key)
+	default:
+		http.Error(w, "unknown lockout kind", http.StatusBadRequest)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "unlock_" + kind, Collection: "users", Detail: key})
+
+	http.Redirect(w, r, "/lockouts", http.StatusFound)
+}
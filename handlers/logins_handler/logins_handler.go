@@ -1,49 +1,217 @@
 package logins_handler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/jameycribbs/pythia/audit"
 	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/login_throttle"
+	"github.com/jameycribbs/pythia/metrics"
 	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_info"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/jameycribbs/pythia/totp"
 	"github.com/justinas/nosurf"
-	"golang.org/x/crypto/bcrypt"
 	"html/template"
 	"net/http"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
+var errNoPendingLogin = errors.New("no pending login")
+
+const pendingLoginLifetime = 5 * time.Minute
+
 type TemplateData struct {
 	Msg               string
+	SsoName           string
 	CurrentUser       *models.User
 	DontShowLoginLink bool
 	CsrfToken         string
 }
 
 func New(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
-	templateData := TemplateData{CurrentUser: currentUser, DontShowLoginLink: true, CsrfToken: nosurf.Token(r)}
-	renderTemplate(w, "new", &templateData)
+	templateData := TemplateData{SsoName: ssoName(gv), CurrentUser: currentUser, DontShowLoginLink: true,
+		CsrfToken: nosurf.Token(r)}
+
+	if r.FormValue("ssoFailed") != "" {
+		templateData.Msg = "Single sign-on login unsuccessful"
+	}
+
+	if r.FormValue("link") != "" {
+		templateData.Msg = "You already have an account here with the same login.  Log in with its password to use " +
+			templateData.SsoName + " for it from now on."
+	}
+
+	renderTemplate(w, r, gv, "new", &templateData)
 }
 
 func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
 	login := r.FormValue("login")
 	password := r.FormValue("password")
 
-	user, err := loginUser(login, password, gv)
+	loginKey := strings.ToLower(strings.TrimSpace(login))
+	ip := request_info.ClientIP(r)
+
+	attempt, wait := reserveAttempt(gv, loginKey, ip)
+	if wait > 0 {
+		recordAudit(gv, r, login, "login_throttled", "")
+
+		msg := fmt.Sprintf("Too many failed login attempts.  Please try again in %v.", roundUp(wait))
+		templateData := TemplateData{Msg: msg, SsoName: ssoName(gv), CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "new", &templateData)
+		return
+	}
+
+	user, err := gv.Authenticator.Authenticate(login, password)
+	if err != nil {
+		recordFailure(gv, r, "password", login, attempt, err.Error())
+
+		templateData := TemplateData{Msg: "Login unsuccessful", SsoName: ssoName(gv), CurrentUser: currentUser,
+			CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "new", &templateData)
+		return
+	}
+
+	// With two-factor on, the password only earns a pending login; the failure
+	// count is left alone until the second step succeeds too.
+	if !StartSession(w, r, gv, user) {
+		refundAttempt(gv, loginKey, ip)
+		http.Redirect(w, r, "/logins/two_factor", http.StatusFound)
+		return
+	}
+
+	succeedAttempt(gv, loginKey, ip)
+	finishLink(w, r, gv, user)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// StartLink holds on to ident, an external identity whose login belongs to a
+// user it isn't linked to, until somebody logs in here with that user's
+// password.  Only then are the two linked, as proof that they are the same
+// person.
+func StartLink(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, ident identity.Identity) {
+	data, err := json.Marshal(ident)
+	if err != nil {
+		request_log.Logger(r).Error("Could not save identity to link", "err", err)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+	session.Values["link_identity"] = string(data)
+	session.Values["link_identity_at"] = strconv.FormatInt(time.Now().Unix(), 10)
+	session.Save(r, w)
+}
+
+// StartSession logs user in on this browser once their first factor has been
+// checked.  If they have two-factor authentication on it only starts a pending
+// login, reports false, and the caller should send them to /logins/two_factor.
+func StartSession(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, user *models.User) bool {
+	session, _ := gv.SessionStore.Get(r, "pythia")
+	gv.SessionStore.Renew(session)
+
+	if user.TotpEnabled {
+		session.Values["pending_user"] = user.FileId
+		session.Values["pending_user_at"] = strconv.FormatInt(time.Now().Unix(), 10)
+		session.Save(r, w)
+
+		return false
+	}
+
+	session.Values["user"] = user.FileId
+	session.Save(r, w)
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: user, Action: "login", Collection: "users", TargetId: user.FileId})
+
+	return true
+}
+
+func TwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	_, err := pendingUser(r, gv)
+	if err != nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, DontShowLoginLink: true, CsrfToken: nosurf.Token(r)}
+	renderTemplate(w, r, gv, "two_factor", &templateData)
+}
+
+func VerifyTwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	user, err := pendingUser(r, gv)
+	if err != nil {
+		http.Redirect(w, r, "/logins/new", http.StatusFound)
+		return
+	}
+
+	code := r.FormValue("code")
+
+	loginKey := strings.ToLower(user.Login)
+	ip := request_info.ClientIP(r)
+
+	templateData := TemplateData{CurrentUser: currentUser, DontShowLoginLink: true, CsrfToken: nosurf.Token(r)}
+
+	attempt, wait := reserveAttempt(gv, loginKey, ip)
+	if wait > 0 {
+		recordAudit(gv, r, user.Login, "login_throttled", "two factor")
+
+		templateData.Msg = fmt.Sprintf("Too many failed login attempts.  Please try again in %v.", roundUp(wait))
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	step, ok := totp.Validate(user.TotpSecret, code, time.Now())
+
+	switch {
+	case ok && step > user.TotpLastStep:
+		user.TotpLastStep = step
+	case !ok && user.UseRecoveryCode(code):
+		recordAudit(gv, r, user.Login, "recovery_code_used", fmt.Sprintf("%v left", len(user.RecoveryCodes)))
+	default:
+		recordFailure(gv, r, "two_factor", user.Login, attempt, "wrong two factor code")
+
+		templateData.Msg = "That code didn't work"
+		renderTemplate(w, r, gv, "two_factor", &templateData)
+		return
+	}
+
+	err = gv.MyDB.Update("users", user, user.FileId)
 	if err != nil {
-		templateData := TemplateData{Msg: "Login unsuccessful", CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
-		renderTemplate(w, "new", &templateData)
+		refundAttempt(gv, loginKey, ip)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
+	succeedAttempt(gv, loginKey, ip)
+
 	session, _ := gv.SessionStore.Get(r, "pythia")
+	gv.SessionStore.Renew(session)
+	delete(session.Values, "pending_user")
+	delete(session.Values, "pending_user_at")
 	session.Values["user"] = user.FileId
 	session.Save(r, w)
 
+	audit.Record(gv.MyDB, r, audit.Event{Actor: user, Action: "login", Collection: "users", TargetId: user.FileId,
+		Detail: "two factor"})
+
+	finishLink(w, r, gv, user)
+
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func Logout(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser != nil {
+		audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "logout", Collection: "users",
+			TargetId: currentUser.FileId})
+	}
+
 	session, _ := gv.SessionStore.Get(r, "pythia")
-	delete(session.Values, "user")
+	session.Options.MaxAge = -1
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -52,38 +220,147 @@ func Logout(w http.ResponseWriter, r *http.Request, throwaway string, gv *global
 //=============================================================================
 // Helper Functions
 //=============================================================================
-func loginUser(login string, password string, gv *global_vars.GlobalVars) (models.User, error) {
+// pendingUser returns the user who has passed the password step and still
+// owes a second factor.  The pending login is only good for a few minutes.
+func pendingUser(r *http.Request, gv *global_vars.GlobalVars) (*models.User, error) {
 	var user models.User
 
-	id, err := gv.MyDB.FindFirstIdForField("users", "login", login)
-	if err != nil {
-		return user, err
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	userId, _ := session.Values["pending_user"].(string)
+	startedAt, _ := session.Values["pending_user_at"].(string)
+
+	started, err := strconv.ParseInt(startedAt, 10, 64)
+	if userId == "" || err != nil || time.Since(time.Unix(started, 0)) > pendingLoginLifetime {
+		return nil, errNoPendingLogin
 	}
 
-	err = gv.MyDB.Find("users", &user, id)
+	err = gv.MyDB.Find("users", &user, userId)
 	if err != nil {
-		return user, err
+		return nil, err
 	}
 
-	fmt.Println(user)
-	fmt.Println(password)
+	if user.IsDeleted() {
+		return nil, errNoPendingLogin
+	}
+
+	return &user, nil
+}
+
+// finishLink links user, who has just logged in with their password, to the
+// identity StartLink held on to, if there is one.  It has to be claimed
+// within a few minutes, like a pending login.
+func finishLink(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, user *models.User) {
+	var ident identity.Identity
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	data, _ := session.Values["link_identity"].(string)
+	startedAt, _ := session.Values["link_identity_at"].(string)
+
+	if data == "" {
+		return
+	}
+
+	delete(session.Values, "link_identity")
+	delete(session.Values, "link_identity_at")
+	session.Save(r, w)
+
+	started, err := strconv.ParseInt(startedAt, 10, 64)
+	if err != nil || time.Since(time.Unix(started, 0)) > pendingLoginLifetime {
+		return
+	}
 
-	err = bcrypt.CompareHashAndPassword(user.Password, []byte(password))
+	err = json.Unmarshal([]byte(data), &ident)
 	if err != nil {
-		return user, err
+		return
+	}
+
+	_, err = identity.Link(gv.MyDB, gv.Webhooks, user, ident)
+	if err != nil {
+		request_log.Logger(r).Warn("Could not link account", "login", user.Login, "source", ident.Source, "err", err)
+	}
+}
+
+func ssoName(gv *global_vars.GlobalVars) string {
+	if gv.Oidc == nil {
+		return ""
+	}
+
+	return gv.Oidc.Name
+}
+
+// attempt is a login attempt reserved against both the login and the address
+// it comes from, with their states should it fail.
+type attempt struct {
+	login login_throttle.Attempts
+	ip    login_throttle.Attempts
+}
+
+// reserveAttempt checks both throttles and, unless one says to wait, reserves
+// an attempt against each before the password is checked, so that a burst of
+// parallel guesses is counted in full.
+func reserveAttempt(gv *global_vars.GlobalVars, loginKey string, ip string) (attempt, time.Duration) {
+	var a attempt
+	var wait time.Duration
+
+	a.login, wait = gv.LoginThrottle.Attempt(loginKey)
+	if wait > 0 {
+		return a, wait
+	}
+
+	a.ip, wait = gv.IpThrottle.Attempt(ip)
+	if wait > 0 {
+		gv.LoginThrottle.Refund(loginKey)
+		return a, wait
 	}
 
-	return user, nil
+	return a, 0
+}
+
+// succeedAttempt clears the login's history.  The address only gets its
+// attempt back: one good password must not reset the counter for an address
+// that is guessing at other accounts.
+func succeedAttempt(gv *global_vars.GlobalVars, loginKey string, ip string) {
+	gv.LoginThrottle.Succeed(loginKey)
+	gv.IpThrottle.Refund(ip)
+}
+
+func refundAttempt(gv *global_vars.GlobalVars, loginKey string, ip string) {
+	gv.LoginThrottle.Refund(loginKey)
+	gv.IpThrottle.Refund(ip)
+}
+
+func recordFailure(gv *global_vars.GlobalVars, r *http.Request, step string, login string, a attempt, reason string) {
+	metrics.LoginFailed(step)
+	request_log.Logger(r).Warn("Login failed", "login", login, "step", step, "reason", reason)
+	recordAudit(gv, r, login, "login_failed", reason)
+
+	if a.login.Locked {
+		recordAudit(gv, r, login, "login_locked", "")
+	}
+
+	if a.ip.Locked {
+		recordAudit(gv, r, login, "ip_locked", a.ip.Key)
+	}
+}
+
+func recordAudit(gv *global_vars.GlobalVars, r *http.Request, login string, action string, detail string) {
+	audit.Record(gv.MyDB, r, audit.Event{ActorLogin: login, Action: action, Collection: "users", Detail: detail})
+}
+
+func roundUp(d time.Duration) time.Duration {
+	return (d + time.Second - 1).Truncate(time.Second)
 }
 
-func renderTemplate(w http.ResponseWriter, templateName string, templateData *TemplateData) {
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "logins", templateName+".html")
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "logins", templateName+".html")
 
 	tmpl, _ := template.ParseFiles(lp, fp)
 	err := tmpl.ExecuteTemplate(w, "layout", templateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 }
@@ -0,0 +1,123 @@
+package oidc_handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/handlers/logins_handler"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/metrics"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+func Login(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if gv.Oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+
+	err = session.Save(r, w)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, gv.Oidc.AuthCodeUrl(state, nonce, verifier), http.StatusFound)
+}
+
+func Callback(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if gv.Oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	session.Save(r, w)
+
+	if state == "" || r.FormValue("state") != state {
+		fail(w, r, gv, "state mismatch")
+		return
+	}
+
+	if errCode := r.FormValue("error"); errCode != "" {
+		fail(w, r, gv, errCode+": "+r.FormValue("error_description"))
+		return
+	}
+
+	ident, err := gv.Oidc.Exchange(r.Context(), r.FormValue("code"), nonce, verifier)
+	if err != nil {
+		fail(w, r, gv, err.Error())
+		return
+	}
+
+	user, err := identity.FindOrProvisionUser(gv.MyDB, gv.Webhooks, ident)
+	if err == identity.ErrLoginTaken {
+		logins_handler.StartLink(w, r, gv, ident)
+		http.Redirect(w, r, "/logins/new?link=1", http.StatusFound)
+		return
+	}
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if !logins_handler.StartSession(w, r, gv, user) {
+		http.Redirect(w, r, "/logins/two_factor", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func fail(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, reason string) {
+	metrics.LoginFailed("oidc")
+	request_log.Logger(r).Warn("Login failed", "step", "oidc", "reason", reason)
+	audit.Record(gv.MyDB, r, audit.Event{Action: "login_failed", Collection: "users", Detail: "oidc: " + reason})
+
+	http.Redirect(w, r, "/logins/new?ssoFailed=1", http.StatusFound)
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
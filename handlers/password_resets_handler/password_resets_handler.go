@@ -0,0 +1,151 @@
+package password_resets_handler
+
+import (
+	"errors"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid or expired password reset token")
+
+type TemplateData struct {
+	Token             string
+	Valid             bool
+	ErrorMsg          string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Edit(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	token := r.FormValue("token")
+
+	_, err := findUsableReset(token, gv)
+
+	templateData := TemplateData{Token: token, Valid: err == nil, CurrentUser: currentUser, DontShowLoginLink: true,
+		CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "edit", &templateData)
+}
+
+func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var user models.User
+
+	token := r.FormValue("token")
+	newPassword := r.FormValue("newPassword")
+	confirmPassword := r.FormValue("confirmPassword")
+
+	templateData := TemplateData{Token: token, CurrentUser: currentUser, DontShowLoginLink: true, CsrfToken: nosurf.Token(r)}
+
+	reset, err := findUsableReset(token, gv)
+	if err != nil {
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	templateData.Valid = true
+
+	err = models.ValidateNewPassword(newPassword, confirmPassword)
+	if err != nil {
+		templateData.ErrorMsg = err.Error()
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	err = gv.MyDB.Find("users", &user, reset.UserId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if user.IsDeleted() {
+		templateData.Valid = false
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	err = user.SetPassword(newPassword)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	// Burn the token before touching the user so a failure part way through
+	// can never leave a link that works twice.
+	reset.UsedAt = time.Now()
+
+	err = gv.MyDB.Update("password_resets", reset, reset.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = gv.MyDB.Update("users", user, user.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = gv.SessionStore.RevokeUser(user.FileId, "")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	err = models.RevokeUserApiTokens(gv.MyDB, user.FileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{ActorLogin: user.Login, Action: "password_reset", Collection: "users",
+		TargetId: user.FileId})
+
+	http.Redirect(w, r, "/logins/new", http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func findUsableReset(token string, gv *global_vars.GlobalVars) (*models.PasswordReset, error) {
+	var reset models.PasswordReset
+
+	if token == "" {
+		return nil, errInvalidToken
+	}
+
+	id, err := gv.MyDB.FindFirstIdForField("password_resets", "tokenhash", models.HashResetToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	err = gv.MyDB.Find("password_resets", &reset, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reset.Usable() {
+		return nil, errInvalidToken
+	}
+
+	return &reset, nil
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "password_resets", templateName+".html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,340 @@
+package questions_handler
+
+import (
+	"fmt"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_info"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type TemplateData struct {
+	Rec               *models.Question
+	Answer            *models.Answer
+	SourceTypes       []models.SourceType
+	ConfidenceLevels  []string
+	Editions          []*models.Edition
+	RulesString       string
+	TagsString        string
+	ChallengeQuestion string
+	ChallengeToken    string
+	Sent              bool
+	ErrorMsg          string
+	CanReview         bool
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+type IndexTemplateData struct {
+	Questions         []*models.Question
+	CanReview         bool
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+// New shows the form a visitor uses to ask a question nobody has answered
+// yet, with the tags from their search filled in.
+func New(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	templateData := TemplateData{Rec: &models.Question{}, TagsString: r.FormValue("tags"), CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	renderForm(w, r, gv, &templateData)
+}
+
+func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	question := strings.TrimSpace(r.FormValue("question"))
+	tags := r.FormValue("tags")
+
+	ip := request_info.ClientIP(r)
+
+	templateData := TemplateData{Rec: &models.Question{Question: question}, TagsString: tags, CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	// People never see the website field, so anything in it was put there by
+	// a bot.  Thank it as usual so it has no reason to try harder.
+	if r.FormValue("website") != "" {
+		templateData.Sent = true
+		renderTemplate(w, r, gv, "new", &templateData)
+		return
+	}
+
+	// Every try counts against the address, wrong answers to the sum as much
+	// as questions sent, so after a few in a row it has to wait longer and
+	// longer before trying again.
+	if _, wait := gv.QuestionThrottle.Attempt(ip); wait > 0 {
+		templateData.ErrorMsg = fmt.Sprintf("You have asked a lot of questions.  Please try again in %v.",
+			(wait + time.Second - 1).Truncate(time.Second))
+		renderForm(w, r, gv, &templateData)
+		return
+	}
+
+	if !gv.Challenge.Verify(r.FormValue("challengeToken"), r.FormValue("challengeAnswer")) {
+		templateData.ErrorMsg = "That wasn't the right answer to the sum, please try again"
+		renderForm(w, r, gv, &templateData)
+		return
+	}
+
+	if question == "" {
+		templateData.ErrorMsg = "Please enter your question"
+		renderForm(w, r, gv, &templateData)
+		return
+	}
+
+	rec := models.Question{Question: question, Tags: strings.Fields(tags), Status: models.QuestionOpen, Ip: ip,
+		CreatedAt: time.Now()}
+
+	fileId, err := gv.MyDB.Create("questions", rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{ActorLogin: "anonymous", Action: "create", Collection: "questions",
+		TargetId: fileId, After: rec})
+
+	rec.FileId = fileId
+	gv.Notifier.Notify(nil, "question_asked", gv.Notifier.Subscribers((*models.User).WantsQuestionEmails), &rec)
+
+	templateData.Sent = true
+	renderTemplate(w, r, gv, "new", &templateData)
+}
+
+// Index is the moderation queue of open questions.
+func Index(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	templateData := IndexTemplateData{CanReview: currentUser.CanReview(), CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	ids, err := gv.MyDB.FindAllIds("questions")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	for _, id := range ids {
+		question := models.Question{}
+
+		err = gv.MyDB.Find("questions", &question, id)
+		if err != nil {
+			request_log.ServerError(w, r, err)
+			return
+		}
+
+		if question.Status != models.QuestionOpen {
+			continue
+		}
+
+		templateData.Questions = append(templateData.Questions, &question)
+	}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "questions", "index.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+// Answer shows the new answer form filled in from a question in the queue.
+func Answer(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var rec models.Question
+
+	err := gv.MyDB.Find("questions", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.Status != models.QuestionOpen {
+		http.Redirect(w, r, "/questions", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{Rec: &rec, Answer: &models.Answer{Question: rec.Question},
+		TagsString: strings.Join(rec.Tags, " "), CanReview: currentUser.CanReview(), CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	renderAnswerForm(w, r, gv, &templateData)
+}
+
+// CreateAnswer turns a question into an answer, which then goes through the
+// same review as any other.
+func CreateAnswer(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if currentUser == nil {
+		http.Redirect(w, r, "/answers", http.StatusFound)
+		return
+	}
+
+	var question models.Question
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("questions", &question, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if question.Status != models.QuestionOpen {
+		http.Redirect(w, r, "/questions", http.StatusFound)
+		return
+	}
+
+	answer := models.Answer{Question: r.FormValue("question"), Answer: r.FormValue("answer"),
+		Tags: strings.Split(r.FormValue("tags"), " "), Status: models.InitialStatus(r.FormValue("status"), currentUser),
+		CreatedById: currentUser.FileId, CreatedAt: time.Now(), UpdatedById: currentUser.FileId, UpdatedAt: time.Now()}
+
+	err = answer.SetSource(r.FormValue("sourceType"), r.FormValue("sourceReference"), r.FormValue("sourceUrl"),
+		r.FormValue("sourceDate"), r.FormValue("confidence"))
+	if err != nil {
+		templateData := TemplateData{Rec: &question, Answer: &answer, TagsString: r.FormValue("tags"),
+			RulesString: r.FormValue("rules"), ErrorMsg: err.Error(), CanReview: currentUser.CanReview(),
+			CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+		renderAnswerForm(w, r, gv, &templateData)
+		return
+	}
+
+	answer.Rules = strings.Fields(r.FormValue("rules"))
+	answer.Editions = r.Form["editions"]
+
+	answerId, err := gv.MyDB.Create("answers", answer)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "answers", TargetId: answerId,
+		Detail: "from question " + fileId, After: answer})
+
+	gv.Webhooks.Fire("answer.created", answerId, answer)
+
+	if answer.Status == models.StatusPending {
+		answer.FileId = answerId
+		gv.Notifier.Notify(currentUser, "answer_submitted",
+			gv.Notifier.Subscribers((*models.User).WantsReviewEmails), &answer)
+	}
+
+	before := question
+
+	question.Status = models.QuestionAnswered
+	question.AnswerId = answerId
+	question.HandledById = currentUser.FileId
+	question.HandledAt = time.Now()
+
+	err = gv.MyDB.Update("questions", question, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "answer", Collection: "questions", TargetId: fileId,
+		Before: before, After: question})
+
+	http.Redirect(w, r, fmt.Sprintf("/answers/%v", answerId), http.StatusFound)
+}
+
+// Dismiss takes spam and duplicates out of the queue.
+func Dismiss(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || !currentUser.CanReview() {
+		http.Redirect(w, r, "/questions", http.StatusFound)
+		return
+	}
+
+	var rec models.Question
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("questions", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.Status != models.QuestionOpen {
+		http.Redirect(w, r, "/questions", http.StatusFound)
+		return
+	}
+
+	before := rec
+
+	rec.Status = models.QuestionDismissed
+	rec.HandledById = currentUser.FileId
+	rec.HandledAt = time.Now()
+
+	err = gv.MyDB.Update("questions", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "dismiss", Collection: "questions", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, "/questions", http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// renderForm shows the question form with a fresh sum to solve.
+func renderForm(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateData *TemplateData) {
+	var err error
+
+	templateData.ChallengeQuestion, templateData.ChallengeToken, err = gv.Challenge.Generate()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	renderTemplate(w, r, gv, "new", templateData)
+}
+
+// renderAnswerForm shows the form for answering a question along with the
+// choices for its source and edition fields.
+func renderAnswerForm(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateData *TemplateData) {
+	var err error
+
+	templateData.Editions, err = models.AllEditions(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData.SourceTypes = models.SourceTypes
+	templateData.ConfidenceLevels = models.ConfidenceLevels
+
+	renderTemplate(w, r, gv, "answer", templateData)
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "questions", templateName+".html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,94 @@
+package trash_handler
+
+import (
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/jameycribbs/pythia/trash"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"path"
+	"time"
+)
+
+type IndexTemplateData struct {
+	Items             []trash.Item
+	Retention         time.Duration
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	items, err := trash.Items(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	templateData := IndexTemplateData{Items: items, Retention: gv.TrashRetention, CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "trash", "index.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+func Restore(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	collection := r.FormValue("collection")
+	fileId := r.FormValue("fileId")
+
+	defer gv.Locks.Lock(collection, fileId)()
+
+	rec, err := trash.Restore(gv.MyDB, collection, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "restore", Collection: collection, TargetId: fileId,
+		After: rec})
+
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
+
+func Purge(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	collection := r.FormValue("collection")
+	fileId := r.FormValue("fileId")
+
+	defer gv.Locks.Lock(collection, fileId)()
+
+	rec, err := trash.Purge(gv.MyDB, collection, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "purge", Collection: collection, TargetId: fileId,
+		Before: rec})
+
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
@@ -2,13 +2,17 @@ package users_handler
 
 import (
 	"fmt"
+	"github.com/jameycribbs/pythia/audit"
 	"github.com/jameycribbs/pythia/global_vars"
 	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
 	"github.com/justinas/nosurf"
 	"golang.org/x/crypto/bcrypt"
 	"html/template"
 	"net/http"
 	"path"
+	"strings"
+	"time"
 )
 
 type IndexTemplateData struct {
@@ -16,8 +20,14 @@ type IndexTemplateData struct {
 	CurrentUser *models.User
 }
 
+const passwordResetLifetime = 24 * time.Hour
+
 type TemplateData struct {
 	Rec               *models.User
+	ResetUrl          string
+	ResetExpiresAt    time.Time
+	ResetEmailed      bool
+	ErrorMsg          string
 	CurrentUser       *models.User
 	DontShowLoginLink bool
 	CsrfToken         string
@@ -37,7 +47,7 @@ func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_
 
 	ids, err := gv.MyDB.FindAllIds("users")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
@@ -46,20 +56,24 @@ func Index(w http.ResponseWriter, r *http.Request, throwAway string, gv *global_
 
 		err = gv.MyDB.Find("users", &user, id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			request_log.ServerError(w, r, err)
 			return
 		}
 
+		if user.IsDeleted() {
+			continue
+		}
+
 		templateData.Users = append(templateData.Users, &user)
 	}
 
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "users", "index.html")
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "users", "index.html")
 
 	tmpl, _ := template.ParseFiles(lp, fp)
 	err = tmpl.ExecuteTemplate(w, "layout", templateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 }
@@ -74,16 +88,21 @@ func View(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars
 
 	err := gv.MyDB.Find("users", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
-	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec}
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
 
-	renderTemplate(w, "view", &templateData)
+	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "view", &templateData)
 }
 
-func New(w http.ResponseWriter, r *http.Request, throwaway string, sv *global_vars.GlobalVars, currentUser *models.User) {
+func New(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
 	if (currentUser == nil) || (currentUser.Level != "admin") {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
@@ -91,7 +110,7 @@ func New(w http.ResponseWriter, r *http.Request, throwaway string, sv *global_va
 
 	templateData := TemplateData{CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
 
-	renderTemplate(w, "new", &templateData)
+	renderTemplate(w, r, gv, "new", &templateData)
 }
 
 func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -103,19 +122,40 @@ func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global
 	name := r.FormValue("name")
 	login := r.FormValue("login")
 	level := r.FormValue("level")
+	email := strings.TrimSpace(r.FormValue("email"))
 
 	password, err := bcrypt.GenerateFromPassword([]byte(r.FormValue("password")), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
 	}
 
-	rec := models.User{Name: name, Login: login, Password: []byte(password), Level: level}
+	rec := models.User{Name: name, Login: login, Password: []byte(password), Level: level, Email: email}
+
+	taken, err := models.LoginTaken(gv.MyDB, login, "")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if taken {
+		templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, ErrorMsg: loginTakenMsg(login),
+			CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "new", &templateData)
+		return
+	}
 
 	fileId, err := gv.MyDB.Create("users", rec)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
 	}
 
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "users", TargetId: fileId,
+		After: rec})
+
+	gv.Webhooks.Fire("user.created", fileId, rec)
+
 	http.Redirect(w, r, fmt.Sprintf("/users/%v", fileId), http.StatusFound)
 }
 
@@ -129,13 +169,18 @@ func Edit(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars
 
 	err := gv.MyDB.Find("users", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
 		return
 	}
 
 	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
 
-	renderTemplate(w, "edit", &templateData)
+	renderTemplate(w, r, gv, "edit", &templateData)
 }
 
 func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -144,21 +189,59 @@ func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global
 		return
 	}
 
+	var rec models.User
+
 	fileId := r.FormValue("fileId")
 
-	name := r.FormValue("name")
-	login := r.FormValue("login")
-	password := r.FormValue("password")
-	level := r.FormValue("level")
+	err := gv.MyDB.Find("users", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
 
-	rec := models.User{FileId: fileId, Name: name, Login: login, Password: []byte(password), Level: level}
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
 
-	err := gv.MyDB.Update("users", rec, fileId)
+	before := rec
+
+	// The password hash is carried over from the stored record; passwords are
+	// only ever changed through the account page or a reset link.
+	rec.Name = r.FormValue("name")
+	rec.Login = r.FormValue("login")
+	rec.Level = r.FormValue("level")
+	rec.Email = strings.TrimSpace(r.FormValue("email"))
+
+	taken, err := models.LoginTaken(gv.MyDB, rec.Login, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if taken {
+		templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, ErrorMsg: loginTakenMsg(rec.Login),
+			CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	err = gv.MyDB.Update("users", rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "users", TargetId: fileId,
+		Before: before, After: rec})
+
+	gv.Webhooks.Fire("user.updated", fileId, rec)
+
+	if rec.Level != before.Level {
+		rec.FileId = fileId
+		gv.Notifier.Notify(currentUser, "level_changed", []*models.User{&rec}, before.Level)
+	}
+
 	http.Redirect(w, r, fmt.Sprintf("/users/%v", fileId), http.StatusFound)
 }
 
@@ -172,13 +255,18 @@ func Delete(w http.ResponseWriter, r *http.Request, fileId string, gv *global_va
 
 	err := gv.MyDB.Find("users", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
 		return
 	}
 
 	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
 
-	renderTemplate(w, "delete", &templateData)
+	renderTemplate(w, r, gv, "delete", &templateData)
 }
 
 func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
@@ -187,28 +275,213 @@ func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *globa
 		return
 	}
 
+	var rec models.User
+
 	fileId := r.FormValue("fileId")
 
-	err := gv.MyDB.Delete("users", fileId)
+	err := gv.MyDB.Find("users", &rec, fileId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = gv.SessionStore.RevokeUser(fileId, "")
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	before := rec
+
+	rec.MoveToTrash(currentUser.FileId)
+
+	err = gv.MyDB.Update("users", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "delete", Collection: "users", TargetId: fileId,
+		Before: before, After: rec})
+
+	gv.Webhooks.Fire("user.deleted", fileId, rec)
+
 	http.Redirect(w, r, "/users", http.StatusFound)
 }
 
+func ResetPassword(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.User
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	err := gv.MyDB.Find("users", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "reset_password", &templateData)
+}
+
+func CreatePasswordReset(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.User
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("users", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = expirePasswordResets(fileId, gv)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	token, tokenHash, err := models.NewResetToken()
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	reset := models.PasswordReset{UserId: fileId, TokenHash: tokenHash, CreatedById: currentUser.FileId,
+		CreatedAt: time.Now(), ExpiresAt: time.Now().Add(passwordResetLifetime)}
+
+	_, err = gv.MyDB.Create("password_resets", reset)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "password_reset_issued", Collection: "users",
+		TargetId: fileId})
+
+	// Without a base URL, which is only allowed when emails are off, the admin
+	// is shown a link relative to the site.
+	resetUrl := fmt.Sprintf("%v/password_resets/edit?token=%v", gv.Notifier.BaseUrl, token)
+
+	// Reset links go out whatever the user's notification settings are; the
+	// admin is shown the link as well in case the user has no email address.
+	gv.Notifier.Notify(nil, "password_reset", []*models.User{&rec},
+		struct {
+			ResetUrl  string
+			ExpiresAt time.Time
+		}{resetUrl, reset.ExpiresAt})
+
+	templateData := TemplateData{CurrentUser: currentUser, Rec: &rec, ResetUrl: resetUrl, ResetExpiresAt: reset.ExpiresAt,
+		ResetEmailed: gv.Notifier.Enabled() && rec.Email != ""}
+
+	renderTemplate(w, r, gv, "reset_link", &templateData)
+}
+
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.User
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("users", &rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	if rec.IsDeleted() {
+		http.NotFound(w, r)
+		return
+	}
+
+	rec.DisableTwoFactor()
+
+	err = gv.MyDB.Update("users", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "two_factor_disabled", Collection: "users",
+		TargetId: fileId})
+
+	http.Redirect(w, r, fmt.Sprintf("/users/%v", fileId), http.StatusFound)
+}
+
 //=============================================================================
 // Helper Functions
 //=============================================================================
-func renderTemplate(w http.ResponseWriter, templateName string, templateData *TemplateData) {
-	lp := path.Join("templates", "layouts", "layout.html")
-	fp := path.Join("templates", "users", templateName+".html")
+func loginTakenMsg(login string) string {
+	return fmt.Sprintf("There is already a user with the login %v.  Logins of users in the trash stay taken until "+
+		"they are deleted for good.", login)
+}
+
+// Only the most recently issued link for a user should work.
+func expirePasswordResets(userId string, gv *global_vars.GlobalVars) error {
+	ids, err := gv.MyDB.FindAllIds("password_resets")
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var reset models.PasswordReset
+
+		err = gv.MyDB.Find("password_resets", &reset, id)
+		if err != nil {
+			return err
+		}
+
+		if reset.UserId != userId || !reset.Usable() {
+			continue
+		}
+
+		reset.UsedAt = time.Now()
+
+		err = gv.MyDB.Update("password_resets", reset, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "users", templateName+".html")
 
 	tmpl, _ := template.ParseFiles(lp, fp)
 	err := tmpl.ExecuteTemplate(w, "layout", templateData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		request_log.ServerError(w, r, err)
 		return
 	}
 }
@@ -0,0 +1,311 @@
+package webhooks_handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/justinas/nosurf"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+type TemplateData struct {
+	Webhooks          []*models.Webhook
+	Rec               *models.Webhook
+	Events            []string
+	Msg               string
+	ErrorMsg          string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+type DeliveriesTemplateData struct {
+	Deliveries        []*models.WebhookDelivery
+	Webhook           *models.Webhook
+	Status            string
+	Msg               string
+	CurrentUser       *models.User
+	DontShowLoginLink bool
+	CsrfToken         string
+}
+
+func Index(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	templateData := TemplateData{Rec: &models.Webhook{Active: true}, CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	renderIndex(w, r, gv, &templateData)
+}
+
+func Create(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	rec := models.Webhook{CreatedById: currentUser.FileId, CreatedAt: time.Now()}
+
+	err := setFields(&rec, r)
+	if err != nil {
+		templateData := TemplateData{Rec: &rec, ErrorMsg: err.Error(), CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+		renderIndex(w, r, gv, &templateData)
+		return
+	}
+
+	fileId, err := gv.MyDB.Create("webhooks", rec)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "create", Collection: "webhooks", TargetId: fileId,
+		After: rec})
+
+	http.Redirect(w, r, fmt.Sprintf("/webhooks/%v/edit", fileId), http.StatusFound)
+}
+
+func Edit(w http.ResponseWriter, r *http.Request, fileId string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Webhook
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	err := gv.MyDB.Find("webhooks", &rec, fileId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	templateData := TemplateData{Rec: &rec, Events: models.WebhookEvents, CurrentUser: currentUser,
+		CsrfToken: nosurf.Token(r)}
+
+	renderTemplate(w, r, gv, "edit", &templateData)
+}
+
+func Update(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Webhook
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("webhooks", &rec, fileId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	before := rec
+
+	err = setFields(&rec, r)
+	if err != nil {
+		templateData := TemplateData{Rec: &rec, Events: models.WebhookEvents, ErrorMsg: err.Error(),
+			CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+		renderTemplate(w, r, gv, "edit", &templateData)
+		return
+	}
+
+	err = gv.MyDB.Update("webhooks", rec, fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "update", Collection: "webhooks", TargetId: fileId,
+		Before: before, After: rec})
+
+	http.Redirect(w, r, "/webhooks", http.StatusFound)
+}
+
+// Destroy removes a webhook for good.  Deliveries still queued for it fail
+// the next time they are tried.
+func Destroy(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	var rec models.Webhook
+
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	err := gv.MyDB.Find("webhooks", &rec, fileId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = gv.MyDB.Delete("webhooks", fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "purge", Collection: "webhooks", TargetId: fileId,
+		Before: rec})
+
+	http.Redirect(w, r, "/webhooks", http.StatusFound)
+}
+
+// Deliveries is the delivery log, newest first, optionally narrowed down to
+// one webhook or one status.
+func Deliveries(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	webhookId := r.FormValue("webhookId")
+	status := r.FormValue("status")
+
+	templateData := DeliveriesTemplateData{Status: status, CurrentUser: currentUser, CsrfToken: nosurf.Token(r)}
+
+	if webhookId != "" {
+		var webhook models.Webhook
+
+		err := gv.MyDB.Find("webhooks", &webhook, webhookId)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		templateData.Webhook = &webhook
+	}
+
+	if r.FormValue("redelivered") != "" {
+		templateData.Msg = "The delivery has been queued again."
+	}
+
+	deliveries, err := models.AllWebhookDeliveries(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if (webhookId == "" || delivery.WebhookId == webhookId) && (status == "" || delivery.Status == status) {
+			templateData.Deliveries = append(templateData.Deliveries, delivery)
+		}
+	}
+
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "webhooks", "deliveries.html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err = tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
+
+// Redeliver sends the payload of an earlier delivery again as a new delivery.
+func Redeliver(w http.ResponseWriter, r *http.Request, throwaway string, gv *global_vars.GlobalVars, currentUser *models.User) {
+	if (currentUser == nil) || (currentUser.Level != "admin") {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	fileId := r.FormValue("fileId")
+
+	newId, err := gv.Webhooks.Redeliver(fileId)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	audit.Record(gv.MyDB, r, audit.Event{Actor: currentUser, Action: "redeliver", Collection: "webhook_deliveries",
+		TargetId: newId, Detail: "copy of delivery " + fileId})
+
+	http.Redirect(w, r, "/webhooks/deliveries?redelivered=1&webhookId="+url.QueryEscape(r.FormValue("webhookId")),
+		http.StatusFound)
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// setFields copies the form onto rec.  A blank secret keeps the current one,
+// or makes up a new one for a new webhook.
+func setFields(rec *models.Webhook, r *http.Request) error {
+	rec.Url = strings.TrimSpace(r.FormValue("url"))
+	rec.Active = r.FormValue("active") == "on"
+	rec.Events = nil
+
+	for _, event := range models.WebhookEvents {
+		for _, wanted := range r.Form["events"] {
+			if wanted == event {
+				rec.Events = append(rec.Events, event)
+			}
+		}
+	}
+
+	if secret := strings.TrimSpace(r.FormValue("secret")); secret != "" {
+		rec.Secret = secret
+	}
+
+	if rec.Secret == "" {
+		b := make([]byte, 24)
+
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+
+		rec.Secret = hex.EncodeToString(b)
+	}
+
+	u, err := url.Parse(rec.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("Please give an http or https URL")
+	}
+
+	if len(rec.Events) == 0 {
+		return errors.New("Please pick at least one event")
+	}
+
+	return nil
+}
+
+func renderIndex(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateData *TemplateData) {
+	var err error
+
+	templateData.Events = models.WebhookEvents
+
+	templateData.Webhooks, err = models.AllWebhooks(gv.MyDB)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+
+	renderTemplate(w, r, gv, "index", templateData)
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, gv *global_vars.GlobalVars, templateName string, templateData *TemplateData) {
+	lp := path.Join(gv.TemplatesDir, "layouts", "layout.html")
+	fp := path.Join(gv.TemplatesDir, "webhooks", templateName+".html")
+
+	tmpl, _ := template.ParseFiles(lp, fp)
+	err := tmpl.ExecuteTemplate(w, "layout", templateData)
+	if err != nil {
+		request_log.ServerError(w, r, err)
+		return
+	}
+}
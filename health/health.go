@@ -0,0 +1,53 @@
+package health
+
+import (
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"net/http"
+	"os"
+)
+
+// Live answers /healthz.  It only shows the process is up and serving
+// requests, so a failure means it should be restarted.
+func Live(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Ready answers /readyz, saying whether the server can do its job: the data
+// directory can be read and every collection can be listed.  The indexes are
+// built when the database is opened, before the server starts listening, so
+// a server that answers at all has them loaded.
+type Ready struct {
+	DB          *ivy.DB
+	DataDir     string
+	Collections []string
+}
+
+func (rd *Ready) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := rd.check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func (rd *Ready) check() error {
+	_, err := os.ReadDir(rd.DataDir)
+	if err != nil {
+		return fmt.Errorf("data directory: %v", err)
+	}
+
+	for _, name := range rd.Collections {
+		_, err = rd.DB.FindAllIds(name)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	return nil
+}
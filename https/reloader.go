@@ -0,0 +1,111 @@
+package https
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate loaded from files and loads it again when
+// they change, so a renewed certificate is picked up without a restart.
+// Each TLS handshake asks for the current certificate, so connections that
+// are already open carry on undisturbed.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp string
+}
+
+// NewReloader loads the certificate and key, failing if they can't be used.
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate is for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reload loads the files again.  If they don't make a valid certificate, for
+// instance because only one of them has been replaced so far, the current
+// certificate stays in use.
+func (r *Reloader) Reload() error {
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.stamp = stamp
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Watch checks the files every interval and reloads them when their size or
+// modification time has changed.  It never returns.
+func (r *Reloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		stamp, err := r.fileStamp()
+		if err != nil {
+			slog.Error("Could not check the TLS certificate files", "err", err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := stamp != r.stamp
+		r.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		err = r.Reload()
+		if err != nil {
+			slog.Error("Could not reload the TLS certificate", "err", err)
+			continue
+		}
+
+		slog.Info("Reloaded the TLS certificate", "file", r.certFile)
+	}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func (r *Reloader) fileStamp() (string, error) {
+	var stamp string
+
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+
+		stamp += fmt.Sprintf("%v:%v:%v;", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return stamp, nil
+}
@@ -0,0 +1,251 @@
+package identity
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/webhooks"
+	"strings"
+)
+
+var (
+	ErrUserDeleted = errors.New("user has been deleted")
+
+	// ErrLoginTaken means nobody is linked to the identity yet and its login
+	// already belongs to a user.  Only that user can link the two, by logging
+	// in with their own password (see Link).
+	ErrLoginTaken = errors.New("login belongs to an existing user")
+
+	// ErrAlreadyLinked means Link was asked to link a user who already logs
+	// in through another source, or an identity that already has a user.
+	ErrAlreadyLinked = errors.New("already linked to another account")
+)
+
+// Identity is what an external authentication source (an OpenID Connect
+// provider, an LDAP directory) tells us about the person logging in.
+type Identity struct {
+	Source  string
+	Subject string
+	Login   string
+	Name    string
+	Email   string
+
+	// EmailVerified is set when the source vouches that Email belongs to this
+	// person.  Only then is it used to find their account or stored on it.
+	EmailVerified bool
+
+	// When ManageLevel is set the source decides the user's level (from its
+	// group to role mapping) and Level overrides whatever is stored, including
+	// demoting to a plain user when Level is empty.
+	Level       string
+	ManageLevel bool
+}
+
+// FindOrProvisionUser returns the Pythia user for ident, creating one the
+// first time somebody logs in.  An existing local account is linked when its
+// email matches a verified email of ident, so people keep their history when
+// they switch to single sign-on.  A matching login is not enough, since the
+// source may let people pick their own; that gets ErrLoginTaken instead.
+// New and changed users are reported to hooks, which may be nil.
+func FindOrProvisionUser(db *ivy.DB, hooks *webhooks.Dispatcher, ident Identity) (*models.User, error) {
+	user, loginTaken, err := findLinkedUser(db, ident)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		if loginTaken {
+			return nil, ErrLoginTaken
+		}
+
+		user = &models.User{Login: ident.Login, Name: ident.Name, AuthSource: ident.Source, ExternalId: ident.Subject,
+			Level: ident.Level}
+
+		if ident.EmailVerified {
+			user.Email = ident.Email
+		}
+
+		if user.Name == "" {
+			user.Name = user.Login
+		}
+
+		fileId, err := db.Create("users", user)
+		if err != nil {
+			return nil, err
+		}
+
+		user.FileId = fileId
+
+		audit.Record(db, nil, audit.Event{ActorLogin: ident.Source, Action: "create", Collection: "users",
+			TargetId: fileId, Detail: "provisioned", After: user})
+
+		hooks.Fire("user.created", fileId, user)
+
+		return user, nil
+	}
+
+	return update(db, hooks, user, ident, "synced")
+}
+
+// Link ties ident to user, a local account whose owner has just proved it is
+// theirs by logging in with its password, and updates the user from ident as
+// FindOrProvisionUser does.
+func Link(db *ivy.DB, hooks *webhooks.Dispatcher, user *models.User, ident Identity) (*models.User, error) {
+	if user.AuthSource != "" {
+		return nil, ErrAlreadyLinked
+	}
+
+	linked, _, err := findLinkedUser(db, ident)
+	if err != nil {
+		return nil, err
+	}
+
+	if linked != nil && linked.AuthSource == ident.Source && linked.ExternalId == ident.Subject {
+		return nil, ErrAlreadyLinked
+	}
+
+	return update(db, hooks, user, ident, "linked")
+}
+
+// ParseRoleMapping parses group=level pairs separated by sep: "," for
+// provider groups, ";" for LDAP group DNs, which contain "," and "=" of their
+// own.  Each pair is split on its last "=".
+func ParseRoleMapping(s string, sep string) (map[string]string, error) {
+	mapping := make(map[string]string)
+
+	for _, pair := range strings.Split(s, sep) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("bad role mapping %q, expected group=level", pair)
+		}
+
+		mapping[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+
+	return mapping, nil
+}
+
+// MapRole returns the highest level any of groups maps to.
+func MapRole(mapping map[string]string, groups []string) string {
+	level := ""
+
+	for _, group := range groups {
+		if mapped, ok := mapping[group]; ok && levelRank(mapped) > levelRank(level) {
+			level = mapped
+		}
+	}
+
+	return level
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func levelRank(level string) int {
+	switch level {
+	case "admin":
+		return 3
+	case "editor":
+		return 2
+	case "":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// findLinkedUser returns the user already linked to ident or, failing that, a
+// local account with its verified email.  It also says whether ident's login
+// belongs to somebody, deleted users included, so that a new account doesn't
+// take it.
+func findLinkedUser(db *ivy.DB, ident Identity) (*models.User, bool, error) {
+	var byEmail *models.User
+	loginTaken := false
+
+	ids, err := db.FindAllIds("users")
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, id := range ids {
+		user := models.User{}
+
+		err = db.Find("users", &user, id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if user.AuthSource == ident.Source && user.ExternalId == ident.Subject {
+			return &user, false, nil
+		}
+
+		if strings.EqualFold(user.Login, ident.Login) {
+			loginTaken = true
+		}
+
+		// Never take over an account that already logs in through somewhere
+		// else, or belongs to somebody else at the same source.
+		if user.AuthSource != "" {
+			continue
+		}
+
+		if ident.EmailVerified && ident.Email != "" && strings.EqualFold(user.Email, ident.Email) {
+			byEmail = &user
+		}
+	}
+
+	return byEmail, loginTaken, nil
+}
+
+// update links user to ident and brings their details up to date from it.
+// Changes, such as a level set by the role mapping, are audited as made by
+// the source.
+func update(db *ivy.DB, hooks *webhooks.Dispatcher, user *models.User, ident Identity,
+	detail string) (*models.User, error) {
+
+	if user.IsDeleted() {
+		return nil, ErrUserDeleted
+	}
+
+	before := *user
+
+	user.AuthSource = ident.Source
+	user.ExternalId = ident.Subject
+
+	if ident.Name != "" {
+		user.Name = ident.Name
+	}
+
+	if ident.Email != "" && ident.EmailVerified {
+		user.Email = ident.Email
+	}
+
+	if ident.ManageLevel {
+		user.Level = ident.Level
+	}
+
+	if user.AuthSource == before.AuthSource && user.ExternalId == before.ExternalId && user.Name == before.Name &&
+		user.Email == before.Email && user.Level == before.Level {
+
+		return user, nil
+	}
+
+	err := db.Update("users", user, user.FileId)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Record(db, nil, audit.Event{ActorLogin: ident.Source, Action: "update", Collection: "users",
+		TargetId: user.FileId, Detail: detail, Before: before, After: user})
+
+	hooks.Fire("user.updated", user.FileId, user)
+
+	return user, nil
+}
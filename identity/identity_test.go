@@ -0,0 +1,161 @@
+package identity
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *ivy.DB {
+	dir := t.TempDir()
+
+	for _, name := range []string{"users", "audit", "password_resets", "sessions", "api_tokens", "answers"} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestParseRoleMapping(t *testing.T) {
+	tests := []struct {
+		s    string
+		sep  string
+		want map[string]string
+	}{
+		{"pythia-admins=admin, pythia-editors=editor", ",",
+			map[string]string{"pythia-admins": "admin", "pythia-editors": "editor"}},
+		{"cn=admins,ou=groups,dc=example,dc=org=admin; cn=editors,ou=groups,dc=example,dc=org=editor", ";",
+			map[string]string{"cn=admins,ou=groups,dc=example,dc=org": "admin",
+				"cn=editors,ou=groups,dc=example,dc=org": "editor"}},
+		{"", ",", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRoleMapping(tt.s, tt.sep)
+		if err != nil {
+			t.Errorf("ParseRoleMapping(%q): %v", tt.s, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRoleMapping(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+
+	_, err := ParseRoleMapping("pythia-admins", ",")
+	if err == nil {
+		t.Error("ParseRoleMapping accepted a pair without a level")
+	}
+}
+
+func TestNoLinkingAcrossSources(t *testing.T) {
+	db := newTestDB(t)
+
+	sso := models.User{Login: "carol", Email: "carol@example.org", AuthSource: "oidc:https://idp.example.org",
+		ExternalId: "carol-sub"}
+
+	ssoId, err := db.Create("users", &sso)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident := Identity{Source: "ldap:ldaps://ldap.example.org", Subject: "uid=carol,ou=people,dc=example,dc=org",
+		Login: "carol2", Email: "carol@example.org", EmailVerified: true}
+
+	user, err := FindOrProvisionUser(db, nil, ident)
+	if err != nil {
+		t.Fatalf("FindOrProvisionUser: %v", err)
+	}
+
+	if user.FileId == ssoId {
+		t.Fatal("LDAP identity was linked to a single sign-on user")
+	}
+
+	err = db.Find("users", &sso, ssoId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sso.AuthSource != "oidc:https://idp.example.org" || sso.ExternalId != "carol-sub" {
+		t.Errorf("single sign-on user changed to %+v", sso)
+	}
+
+	_, err = FindOrProvisionUser(db, nil, Identity{Source: ident.Source, Subject: "uid=other", Login: "carol"})
+	if err != ErrLoginTaken {
+		t.Errorf("login of a single sign-on user: got %v, want ErrLoginTaken", err)
+	}
+}
+
+func TestProvisioningIsAudited(t *testing.T) {
+	db := newTestDB(t)
+
+	ident := Identity{Source: "oidc:https://idp.example.org", Subject: "dave-sub", Login: "dave", ManageLevel: true,
+		Level: "editor"}
+
+	user, err := FindOrProvisionUser(db, nil, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging in again with nothing changed is not worth an entry.
+	_, err = FindOrProvisionUser(db, nil, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident.Level = "admin"
+
+	_, err = FindOrProvisionUser(db, nil, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.FindAllIds("audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+
+	for _, id := range ids {
+		entry := models.AuditEntry{}
+
+		err = db.Find("audit", &entry, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entry.ActorLogin != ident.Source || entry.TargetId != user.FileId {
+			t.Errorf("entry %+v", entry)
+		}
+
+		got = append(got, entry.Action+" "+entry.Detail)
+
+		if entry.Action == "update" && (!strings.Contains(string(entry.Before), `"editor"`) ||
+			!strings.Contains(string(entry.After), `"admin"`)) {
+
+			t.Errorf("level change recorded as %s -> %s", entry.Before, entry.After)
+		}
+	}
+
+	sort.Strings(got)
+
+	if want := []string{"create provisioned", "update synced"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("audit entries %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package login_throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Throttle counts failed attempts per key (a login name or an IP address).
+// Once a key has used up its free attempts, each further failure doubles the
+// time it has to wait before trying again, and after lockoutAfter failures the
+// key is locked out for the whole lockout period.
+//
+// Anybody can make up keys, so at most maxKeys are remembered; when that many
+// have failures on record, the one that failed longest ago is forgotten to
+// make room.
+type Throttle struct {
+	mu            sync.Mutex
+	attempts      map[string]*Attempts
+	freeAttempts  int
+	lockoutAfter  int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	lockoutPeriod time.Duration
+}
+
+const maxKeys = 100000
+
+type Attempts struct {
+	Key          string
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+	Locked       bool
+}
+
+func New(freeAttempts int, lockoutAfter int, baseDelay time.Duration, maxDelay time.Duration,
+	lockoutPeriod time.Duration) *Throttle {
+
+	return &Throttle{attempts: make(map[string]*Attempts), freeAttempts: freeAttempts, lockoutAfter: lockoutAfter,
+		baseDelay: baseDelay, maxDelay: maxDelay, lockoutPeriod: lockoutPeriod}
+}
+
+// Attempt checks and reserves an attempt for key in one step.  If key has to
+// wait, it returns how long and nothing is recorded.  Otherwise the attempt is
+// counted as a failure straight away, so that attempts made in parallel can't
+// all get in before the first of them has failed; call Succeed or Refund if it
+// turns out to succeed.  The returned state is as it will be if it fails.
+func (t *Throttle) Attempt(key string) (Attempts, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	a := t.lookup(key, now)
+	if a != nil && a.BlockedUntil.After(now) {
+		return *a, a.BlockedUntil.Sub(now)
+	}
+
+	return t.fail(key, a, now), 0
+}
+
+// Fail records a failed attempt and returns the state of key afterwards.
+func (t *Throttle) Fail(key string) Attempts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	return t.fail(key, t.lookup(key, now), now)
+}
+
+// Refund takes back an attempt reserved by Attempt that turned out not to be a
+// failure, without forgetting the failures before it.
+func (t *Throttle) Refund(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a := t.lookup(key, time.Now())
+	if a == nil {
+		return
+	}
+
+	a.Failures--
+
+	if a.Failures <= 0 {
+		delete(t.attempts, key)
+		return
+	}
+
+	t.block(a, a.LastFailure)
+}
+
+// Succeed clears the failure history for key.
+func (t *Throttle) Succeed(key string) {
+	t.Unlock(key)
+}
+
+func (t *Throttle) Unlock(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, key)
+}
+
+// Entries returns every key that currently has failures on record, sorted by key.
+func (t *Throttle) Entries() []Attempts {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var entries []Attempts
+
+	now := time.Now()
+
+	for key := range t.attempts {
+		a := t.lookup(key, now)
+		if a != nil {
+			entries = append(entries, *a)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	return entries
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// fail counts a failure against key, whose attempts so far are a (nil for
+// none).  Callers must hold t.mu.
+func (t *Throttle) fail(key string, a *Attempts, now time.Time) Attempts {
+	if a == nil {
+		if len(t.attempts) >= maxKeys {
+			t.evict(now)
+		}
+
+		a = &Attempts{Key: key}
+		t.attempts[key] = a
+	}
+
+	a.Failures++
+	a.LastFailure = now
+
+	t.block(a, now)
+
+	return *a
+}
+
+// block works out how long a has to wait, counting from now.  Callers must
+// hold t.mu.
+func (t *Throttle) block(a *Attempts, now time.Time) {
+	a.Locked = false
+	a.BlockedUntil = time.Time{}
+
+	switch {
+	case a.Failures >= t.lockoutAfter:
+		a.Locked = true
+		a.BlockedUntil = now.Add(t.lockoutPeriod)
+	case a.Failures > t.freeAttempts:
+		delay := t.baseDelay << uint(a.Failures-t.freeAttempts-1)
+		if delay > t.maxDelay || delay <= 0 {
+			delay = t.maxDelay
+		}
+		a.BlockedUntil = now.Add(delay)
+	}
+}
+
+// evict makes room for a new key by forgetting the ones that have aged out,
+// or failing that the one whose last failure is oldest.  Callers must hold
+// t.mu.
+func (t *Throttle) evict(now time.Time) {
+	var oldest *Attempts
+
+	for key := range t.attempts {
+		a := t.lookup(key, now)
+		if a != nil && (oldest == nil || a.LastFailure.Before(oldest.LastFailure)) {
+			oldest = a
+		}
+	}
+
+	if len(t.attempts) >= maxKeys && oldest != nil {
+		delete(t.attempts, oldest.Key)
+	}
+}
+
+// lookup returns the attempts for key, forgetting them first if they have aged
+// out.  Callers must hold t.mu.
+func (t *Throttle) lookup(key string, now time.Time) *Attempts {
+	a, ok := t.attempts[key]
+	if !ok {
+		return nil
+	}
+
+	if now.After(a.BlockedUntil) && now.Sub(a.LastFailure) > t.lockoutPeriod {
+		delete(t.attempts, key)
+		return nil
+	}
+
+	if a.Locked && now.After(a.BlockedUntil) {
+		a.Locked = false
+	}
+
+	return a
+}
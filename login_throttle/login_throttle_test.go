@@ -0,0 +1,94 @@
+package login_throttle
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelAttemptsAreAllCounted(t *testing.T) {
+	th := New(3, 10, time.Second, time.Minute, time.Hour)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, wait := th.Attempt("alice")
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// The three free attempts and the first delayed one get in; the rest are
+	// told to wait, however many arrive at once.
+	if allowed != 4 {
+		t.Errorf("%v of 50 parallel attempts allowed, want 4", allowed)
+	}
+}
+
+func TestRefundAndSucceed(t *testing.T) {
+	th := New(1, 10, time.Minute, time.Hour, time.Hour)
+
+	th.Attempt("alice")
+	th.Refund("alice")
+
+	if _, wait := th.Attempt("alice"); wait != 0 {
+		t.Fatalf("refunded attempt still counted, wait %v", wait)
+	}
+
+	if _, wait := th.Attempt("alice"); wait != 0 {
+		t.Fatalf("second attempt has to wait %v, want the free one", wait)
+	}
+
+	if _, wait := th.Attempt("alice"); wait == 0 {
+		t.Fatal("third attempt allowed straight after two failures")
+	}
+
+	th.Succeed("alice")
+
+	if len(th.Entries()) != 0 {
+		t.Errorf("entries after Succeed: %v", th.Entries())
+	}
+}
+
+func TestLockout(t *testing.T) {
+	th := New(100, 3, time.Second, time.Minute, time.Hour)
+
+	var a Attempts
+
+	for i := 0; i < 3; i++ {
+		a, _ = th.Attempt("10.0.0.1")
+	}
+
+	if !a.Locked {
+		t.Fatalf("not locked after 3 failures: %+v", a)
+	}
+
+	if _, wait := th.Attempt("10.0.0.1"); wait < 59*time.Minute {
+		t.Errorf("locked key waits %v, want the lockout period", wait)
+	}
+}
+
+func TestKeysAreCapped(t *testing.T) {
+	th := New(3, 10, time.Second, time.Minute, time.Hour)
+
+	for i := 0; i < maxKeys+10; i++ {
+		th.Fail(fmt.Sprint("login", i))
+	}
+
+	if n := len(th.attempts); n > maxKeys {
+		t.Errorf("%v keys remembered, want at most %v", n, maxKeys)
+	}
+}
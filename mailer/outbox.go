@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Outbox doesn't send anything.  It writes each message to a .eml file in
+// Dir, or logs it when Dir is "-".
+type Outbox struct {
+	Dir  string
+	From string
+
+	mu    sync.Mutex
+	count int
+}
+
+func (o *Outbox) Send(msg Message) error {
+	if o.Dir == "-" {
+		slog.Info("Email not sent", "message", string(msg.Bytes(o.From)))
+		return nil
+	}
+
+	o.mu.Lock()
+	o.count++
+	name := fmt.Sprintf("%v-%v.eml", time.Now().Format("20060102-150405"), o.count)
+	o.mu.Unlock()
+
+	return os.WriteFile(filepath.Join(o.Dir, name), msg.Bytes(o.From), 0600)
+}
@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// Smtp sends mail through an SMTP server, switching to TLS with STARTTLS
+// whenever the server offers it.  Leave Username empty for servers that
+// don't want a login.
+type Smtp struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s Smtp) Send(msg Message) error {
+	var auth smtp.Auth
+
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	return smtp.SendMail(s.Addr, auth, s.From, msg.To, msg.Bytes(s.From))
+}
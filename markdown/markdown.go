@@ -0,0 +1,25 @@
+package markdown
+
+import (
+	"bytes"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"html/template"
+	"log/slog"
+)
+
+var md = goldmark.New(goldmark.WithExtensions(extension.Linkify, extension.Strikethrough))
+
+// Render turns Markdown into HTML.  Raw HTML and javascript: links in the
+// source are left out, so the result is safe to put straight into a page.
+func Render(source string) template.HTML {
+	var buf bytes.Buffer
+
+	err := md.Convert([]byte(source), &buf)
+	if err != nil {
+		slog.Error("Could not render markdown", "err", err)
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/request_info"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pythia_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pythia_http_request_duration_seconds",
+		Help:    "How long HTTP requests took to answer, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	searches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pythia_searches_total",
+		Help: "Answer searches by where they were made: web, api or chat.",
+	}, []string{"source"})
+
+	zeroResultSearches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pythia_zero_result_searches_total",
+		Help: "Answer searches that found nothing, by where they were made.",
+	}, []string{"source"})
+
+	loginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pythia_login_failures_total",
+		Help: "Failed logins by step: password, two_factor or oidc.",
+	}, []string{"method"})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, searches, zeroResultSearches, loginFailures)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware counts and times the requests a mux router handles.  They are
+// labelled with the route's path template rather than the path, so that
+// /answers/12 and /answers/13 are counted together.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := request_info.Route(r)
+		if route == "" {
+			route = "unknown"
+		}
+
+		rec := request_info.NewRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(rec, r)
+
+		requests.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status)).Inc()
+		requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Search counts a search made from source that found results answers.
+func Search(source string, results int) {
+	searches.WithLabelValues(source).Inc()
+
+	if results == 0 {
+		zeroResultSearches.WithLabelValues(source).Inc()
+	}
+}
+
+// LoginFailed counts a failed login at the step given by method.
+func LoginFailed(method string) {
+	loginFailures.WithLabelValues(method).Inc()
+}
+
+// CountRecords adds a gauge of how many records each of collections holds.
+// They are counted afresh every time the metrics are scraped.
+func CountRecords(db *ivy.DB, collections []string) {
+	prometheus.MustRegister(&recordCounter{db: db, collections: collections})
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+var recordsDesc = prometheus.NewDesc("pythia_records", "Records in each collection, including any in the trash.",
+	[]string{"collection"}, nil)
+
+type recordCounter struct {
+	db          *ivy.DB
+	collections []string
+}
+
+func (c *recordCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- recordsDesc
+}
+
+func (c *recordCounter) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range c.collections {
+		ids, err := c.db.FindAllIds(name)
+		if err != nil {
+			slog.Error("Could not count records", "collection", name, "err", err)
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(recordsDesc, prometheus.GaugeValue, float64(len(ids)), name)
+	}
+}
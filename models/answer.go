@@ -1,22 +1,48 @@
 package models
 
 import (
-	"fmt"
 	"github.com/jameycribbs/ivy"
+	"log/slog"
+	"math"
+	"strings"
 	"time"
 )
 
+const (
+	StatusDraft     = "draft"
+	StatusPending   = "pending"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
 type Answer struct {
-	FileId      string    `json:"-"y`
-	Question    string    `json:"question"`
-	Answer      string    `json:"answer"`
-	CreatedById string    `json:"createdbyid"`
-	UpdatedById string    `json:"updatedbyid"`
-	CreatedAt   time.Time `json:"createdat"`
-	UpdatedAt   time.Time `json:"updatedat"`
-	Tags        []string  `json:"tags"`
-	CreatedBy   string    `json:"-"`
-	UpdatedBy   string    `json:"-"`
+	FileId        string    `json:"-"`
+	Question      string    `json:"question"`
+	Answer        string    `json:"answer"`
+	CreatedById   string    `json:"createdbyid"`
+	UpdatedById   string    `json:"updatedbyid"`
+	CreatedAt     time.Time `json:"createdat"`
+	UpdatedAt     time.Time `json:"updatedat"`
+	Tags          []string  `json:"tags"`
+	Source        Citation  `json:"source"`
+	Confidence    string    `json:"confidence"`
+	Rules         []string  `json:"rules"`
+	Editions      []string  `json:"editions"`
+	NeedsReview   bool      `json:"needsreview"`
+	ReviewReason  string    `json:"reviewreason"`
+	VerifiedAt    time.Time `json:"verifiedat"`
+	VerifiedById  string    `json:"verifiedbyid"`
+	VerifyEvery   int       `json:"verifyevery"`
+	Status        string    `json:"status"`
+	ReviewComment string    `json:"reviewcomment"`
+	ReviewedById  string    `json:"reviewedbyid"`
+	ReviewedAt    time.Time `json:"reviewedat"`
+	HelpedCount   int       `json:"helpedcount"`
+	UnhelpedCount int       `json:"unhelpedcount"`
+	CreatedBy     string    `json:"-"`
+	UpdatedBy     string    `json:"-"`
+	ReviewedBy    string    `json:"-"`
+	Trash
 }
 
 func (answer *Answer) AfterFind(db *ivy.DB, fileId string) {
@@ -27,17 +53,161 @@ func (answer *Answer) AfterFind(db *ivy.DB, fileId string) {
 
 	answer.FileId = fileId
 
+	// Answers written before there was a review step were all public.
+	if answer.Status == "" {
+		answer.Status = StatusPublished
+	}
+
 	err := db.Find("users", &createUser, answer.CreatedById)
 	if err != nil {
-		fmt.Println("Could not find creator:", err)
+		slog.Error("Could not find creator", "answer", fileId, "err", err)
 	}
 
 	answer.CreatedBy = createUser.Name
 
 	err = db.Find("users", &updateUser, answer.UpdatedById)
 	if err != nil {
-		fmt.Println("Could not find updater:", err)
+		slog.Error("Could not find updater", "answer", fileId, "err", err)
 	}
 
 	answer.UpdatedBy = updateUser.Name
+
+	if answer.ReviewedById != "" {
+		var reviewUser User
+
+		err = db.Find("users", &reviewUser, answer.ReviewedById)
+		if err != nil {
+			slog.Error("Could not find reviewer", "answer", fileId, "err", err)
+		}
+
+		answer.ReviewedBy = reviewUser.Name
+	}
+}
+
+// InitialStatus returns the status a new answer written by user starts in
+// when they asked for requested.  Only reviewers can publish straight away;
+// everyone else starts with a draft or sends the answer off for review.
+func InitialStatus(requested string, user *User) string {
+	switch {
+	case requested == StatusPublished && user.CanReview():
+		return StatusPublished
+	case requested == StatusPending:
+		return StatusPending
+	default:
+		return StatusDraft
+	}
+}
+
+// VisibleTo reports whether user may read the answer.  Published answers are
+// public; anything else is only shown to its author and to reviewers.
+func (answer *Answer) VisibleTo(user *User) bool {
+	if answer.Status == StatusPublished {
+		return true
+	}
+
+	return user != nil && (user.CanReview() || answer.CreatedById == user.FileId)
+}
+
+// EditableBy reports whether user may change or delete the answer.  Authors
+// can only work on their own answers until they have been published.
+func (answer *Answer) EditableBy(user *User) bool {
+	if user == nil {
+		return false
+	}
+
+	if user.CanReview() {
+		return true
+	}
+
+	return answer.CreatedById == user.FileId &&
+		(answer.Status == StatusDraft || answer.Status == StatusPending)
+}
+
+func (answer *Answer) VoteCount() int {
+	return answer.HelpedCount + answer.UnhelpedCount
+}
+
+// HelpedPercent is the share of votes that said the answer helped.
+func (answer *Answer) HelpedPercent() int {
+	if answer.VoteCount() == 0 {
+		return 0
+	}
+
+	return int(math.Round(float64(answer.HelpedCount) * 100 / float64(answer.VoteCount())))
+}
+
+// HelpfulnessScore is the lower bound of the Wilson score interval for the
+// share of helped votes, so a handful of votes counts for less than plenty of
+// them at the same ratio.  It is 0 for an answer nobody has voted on.
+func (answer *Answer) HelpfulnessScore() float64 {
+	n := float64(answer.VoteCount())
+	if n == 0 {
+		return 0
+	}
+
+	const z = 1.96
+
+	p := float64(answer.HelpedCount) / n
+
+	return (p + z*z/(2*n) - z*math.Sqrt((p*(1-p)+z*z/(4*n))/n)) / (1 + z*z/n)
+}
+
+// AppliesTo reports whether the answer holds for the edition with the given
+// id.  An answer that doesn't name any editions applies to all of them.
+func (answer *Answer) AppliesTo(editionId string) bool {
+	return editionId == "" || len(answer.Editions) == 0 || answer.NamesEdition(editionId)
+}
+
+// NamesEdition reports whether the answer explicitly lists the edition.
+func (answer *Answer) NamesEdition(editionId string) bool {
+	for _, id := range answer.Editions {
+		if id == editionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CitesAny returns the rules in rules that the answer cites.
+func (answer *Answer) CitesAny(rules []string) []string {
+	var cited []string
+
+	for _, rule := range rules {
+		for _, own := range answer.Rules {
+			if strings.EqualFold(rule, own) {
+				cited = append(cited, rule)
+				break
+			}
+		}
+	}
+
+	return cited
+}
+
+// LastVerified is when somebody last confirmed the answer was right, either
+// explicitly or by editing it.
+func (answer *Answer) LastVerified() time.Time {
+	if answer.VerifiedAt.After(answer.UpdatedAt) {
+		return answer.VerifiedAt
+	}
+
+	return answer.UpdatedAt
+}
+
+// VerifyDue is when the answer should next be checked.  VerifyEvery is in
+// days; answers without their own interval use defaultInterval.
+func (answer *Answer) VerifyDue(defaultInterval time.Duration) time.Time {
+	interval := defaultInterval
+
+	if answer.VerifyEvery > 0 {
+		interval = time.Duration(answer.VerifyEvery) * 24 * time.Hour
+	}
+
+	return answer.LastVerified().Add(interval)
+}
+
+// Overdue reports whether a published answer is past due for checking.
+func (answer *Answer) Overdue(now time.Time, defaultInterval time.Duration) bool {
+	return answer.Status == StatusPublished && !answer.IsDeleted() && now.After(answer.VerifyDue(defaultInterval))
 }
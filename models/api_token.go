@@ -0,0 +1,70 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"sort"
+	"time"
+)
+
+// ApiToken lets a program such as the command-line client use the JSON API
+// as its user.  Like reset tokens, only the hash is stored.
+type ApiToken struct {
+	FileId     string    `json:"-"`
+	UserId     string    `json:"userid"`
+	Name       string    `json:"name"`
+	TokenHash  string    `json:"tokenhash"`
+	CreatedAt  time.Time `json:"createdat"`
+	LastUsedAt time.Time `json:"lastusedat"`
+}
+
+func (token *ApiToken) AfterFind(db *ivy.DB, fileId string) {
+	*token = ApiToken(*token)
+
+	token.FileId = fileId
+}
+
+// UserApiTokens returns the user's API tokens, newest first.
+func UserApiTokens(db *ivy.DB, userId string) ([]*ApiToken, error) {
+	var tokens []*ApiToken
+
+	ids, err := db.FindAllIds("api_tokens")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		token := ApiToken{}
+
+		err = db.Find("api_tokens", &token, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.UserId == userId {
+			tokens = append(tokens, &token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+
+	return tokens, nil
+}
+
+// RevokeUserApiTokens deletes all of the user's API tokens.  A new password
+// should shut out whoever knew the old one, and a token they made with it
+// would otherwise go on working.
+func RevokeUserApiTokens(db *ivy.DB, userId string) error {
+	tokens, err := UserApiTokens(db, userId)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		err = db.Delete("api_tokens", token.FileId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevokeUserApiTokens(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(dir, "api_tokens"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := ivy.OpenDB(dir, FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, token := range []ApiToken{{UserId: "1", Name: "laptop"}, {UserId: "1", Name: "bot"}, {UserId: "2", Name: "other"}} {
+		_, err = db.Create("api_tokens", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = RevokeUserApiTokens(db, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := UserApiTokens(db, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 0 {
+		t.Errorf("%v tokens left after revoking", len(tokens))
+	}
+
+	tokens, err = UserApiTokens(db, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 1 {
+		t.Errorf("another user's tokens revoked too")
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/jameycribbs/ivy"
+	"time"
+)
+
+type AuditEntry struct {
+	FileId     string          `json:"-"`
+	ActorId    string          `json:"actorid"`
+	ActorLogin string          `json:"actorlogin"`
+	Action     string          `json:"action"`
+	Collection string          `json:"collection"`
+	TargetId   string          `json:"targetid"`
+	Detail     string          `json:"detail"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	Ip         string          `json:"ip"`
+	CreatedAt  time.Time       `json:"createdat"`
+}
+
+func (entry *AuditEntry) AfterFind(db *ivy.DB, fileId string) {
+	*entry = AuditEntry(*entry)
+
+	entry.FileId = fileId
+}
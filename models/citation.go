@@ -0,0 +1,117 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type SourceType struct {
+	Value string
+	Label string
+}
+
+// SourceTypes lists where an answer can come from, roughly from most to
+// least authoritative.
+var SourceTypes = []SourceType{
+	{"rulebook", "Rulebook"},
+	{"errata", "Errata"},
+	{"official-qa", "Official Q&A"},
+	{"forum", "Forum"},
+	{"house-rule", "House Rule"},
+}
+
+var ConfidenceLevels = []string{"high", "medium", "low"}
+
+// Citation says where an answer comes from.  Reference is free text such as a
+// page number or the title of a forum thread.
+type Citation struct {
+	Type      string    `json:"type"`
+	Reference string    `json:"reference"`
+	Url       string    `json:"url"`
+	Date      time.Time `json:"date"`
+}
+
+// ParseCitation builds a citation from form values, checking the source type
+// and that the URL, if any, is a web link.  date is in the form 2006-01-02.
+func ParseCitation(sourceType string, reference string, link string, date string) (Citation, error) {
+	citation := Citation{Type: sourceType, Reference: strings.TrimSpace(reference), Url: strings.TrimSpace(link)}
+
+	if sourceType != "" && SourceTypeLabel(sourceType) == "" {
+		return citation, errors.New("Unknown source type")
+	}
+
+	if citation.Url != "" {
+		u, err := url.Parse(citation.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return citation, errors.New("The source URL must start with http:// or https://")
+		}
+	}
+
+	if date != "" {
+		d, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return citation, errors.New("The source date must look like 2006-01-02")
+		}
+
+		citation.Date = d
+	}
+
+	return citation, nil
+}
+
+// SetSource sets the answer's citation and confidence level from form values.
+func (answer *Answer) SetSource(sourceType string, reference string, link string, date string, confidence string) error {
+	var err error
+
+	answer.Source, err = ParseCitation(sourceType, reference, link, date)
+	if err != nil {
+		return err
+	}
+
+	answer.Confidence = confidence
+
+	if !ValidConfidence(confidence) {
+		return errors.New("Unknown confidence level")
+	}
+
+	return nil
+}
+
+func ValidConfidence(confidence string) bool {
+	if confidence == "" {
+		return true
+	}
+
+	for _, level := range ConfidenceLevels {
+		if confidence == level {
+			return true
+		}
+	}
+
+	return false
+}
+
+func SourceTypeLabel(sourceType string) string {
+	for _, st := range SourceTypes {
+		if st.Value == sourceType {
+			return st.Label
+		}
+	}
+
+	return ""
+}
+
+func (citation Citation) Label() string {
+	return SourceTypeLabel(citation.Type)
+}
+
+// DateString is the date as used by date inputs, or empty if there is none.
+func (citation Citation) DateString() string {
+	if citation.Date.IsZero() {
+		return ""
+	}
+
+	return citation.Date.Format("2006-01-02")
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/markdown"
+	"html/template"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// CommentEditWindow is how long authors can keep fixing up a comment after
+// posting it.
+const CommentEditWindow = 15 * time.Minute
+
+// Comment is part of the discussion under an answer.  Replies point at the
+// comment they answer through ParentId; top level comments have none.
+type Comment struct {
+	FileId      string    `json:"-"`
+	AnswerId    string    `json:"answerid"`
+	ParentId    string    `json:"parentid"`
+	Body        string    `json:"body"`
+	CreatedById string    `json:"createdbyid"`
+	CreatedAt   time.Time `json:"createdat"`
+	UpdatedAt   time.Time `json:"updatedat"`
+	Hidden      bool      `json:"hidden"`
+	HiddenById  string    `json:"hiddenbyid"`
+	CreatedBy   string    `json:"-"`
+	Trash
+}
+
+func (comment *Comment) AfterFind(db *ivy.DB, fileId string) {
+	var createUser User
+
+	*comment = Comment(*comment)
+
+	comment.FileId = fileId
+
+	err := db.Find("users", &createUser, comment.CreatedById)
+	if err != nil {
+		slog.Error("Could not find creator", "comment", fileId, "err", err)
+	}
+
+	comment.CreatedBy = createUser.Name
+}
+
+func (comment *Comment) BodyHtml() template.HTML {
+	return markdown.Render(comment.Body)
+}
+
+func (comment *Comment) Edited() bool {
+	return comment.UpdatedAt.After(comment.CreatedAt)
+}
+
+// EditableBy reports whether user may still change the comment.
+func (comment *Comment) EditableBy(user *User) bool {
+	return user != nil && comment.CreatedById == user.FileId && !comment.Hidden && !comment.IsDeleted() &&
+		time.Since(comment.CreatedAt) < CommentEditWindow
+}
+
+// AnswerComments returns every comment on an answer, oldest first, including
+// hidden ones and those in the trash.
+func AnswerComments(db *ivy.DB, answerId string) ([]*Comment, error) {
+	var comments []*Comment
+
+	ids, err := db.FindAllIds("comments")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		comment := Comment{}
+
+		err = db.Find("comments", &comment, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if comment.AnswerId == answerId {
+			comments = append(comments, &comment)
+		}
+	}
+
+	sort.Slice(comments, func(i, j int) bool { return comments[i].CreatedAt.Before(comments[j].CreatedAt) })
+
+	return comments, nil
+}
+
+// CommentCounts returns how many visible comments each answer has, keyed by
+// answer id.
+func CommentCounts(db *ivy.DB) (map[string]int, error) {
+	counts := make(map[string]int)
+
+	ids, err := db.FindAllIds("comments")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		comment := Comment{}
+
+		err = db.Find("comments", &comment, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if !comment.Hidden && !comment.IsDeleted() {
+			counts[comment.AnswerId]++
+		}
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"sort"
+	"time"
+)
+
+// Edition is a release of the rules.  ChangedRules lists the rules it changed,
+// written the same way answers cite them in Rules.
+type Edition struct {
+	FileId       string    `json:"-"`
+	Name         string    `json:"name"`
+	ReleasedAt   time.Time `json:"releasedat"`
+	ChangedRules []string  `json:"changedrules"`
+	CreatedById  string    `json:"createdbyid"`
+	CreatedAt    time.Time `json:"createdat"`
+}
+
+func (edition *Edition) AfterFind(db *ivy.DB, fileId string) {
+	*edition = Edition(*edition)
+
+	edition.FileId = fileId
+}
+
+// AllEditions returns every edition, oldest first.
+func AllEditions(db *ivy.DB) ([]*Edition, error) {
+	var editions []*Edition
+
+	ids, err := db.FindAllIds("editions")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		edition := Edition{}
+
+		err = db.Find("editions", &edition, id)
+		if err != nil {
+			return nil, err
+		}
+
+		editions = append(editions, &edition)
+	}
+
+	sort.Slice(editions, func(i, j int) bool { return editions[i].ReleasedAt.Before(editions[j].ReleasedAt) })
+
+	return editions, nil
+}
+
+// EditionNames maps edition ids to their names.
+func EditionNames(editions []*Edition) map[string]string {
+	names := make(map[string]string)
+
+	for _, edition := range editions {
+		names[edition.FileId] = edition.Name
+	}
+
+	return names
+}
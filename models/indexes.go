@@ -0,0 +1,14 @@
+package models
+
+// FieldsToIndex lists, for each collection, the fields ivy keeps an index of.
+// Everything that opens the data directory must use the same list.
+func FieldsToIndex() map[string][]string {
+	fieldsToIndex := make(map[string][]string)
+	fieldsToIndex["answers"] = []string{"tags"}
+	fieldsToIndex["users"] = []string{"login"}
+	fieldsToIndex["password_resets"] = []string{"tokenhash"}
+	fieldsToIndex["sessions"] = []string{"tokenhash"}
+	fieldsToIndex["api_tokens"] = []string{"tokenhash"}
+
+	return fieldsToIndex
+}
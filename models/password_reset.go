@@ -0,0 +1,51 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jameycribbs/ivy"
+	"time"
+)
+
+type PasswordReset struct {
+	FileId      string    `json:"-"`
+	UserId      string    `json:"userid"`
+	TokenHash   string    `json:"tokenhash"`
+	CreatedById string    `json:"createdbyid"`
+	CreatedAt   time.Time `json:"createdat"`
+	ExpiresAt   time.Time `json:"expiresat"`
+	UsedAt      time.Time `json:"usedat"`
+}
+
+func (reset *PasswordReset) AfterFind(db *ivy.DB, fileId string) {
+	*reset = PasswordReset(*reset)
+
+	reset.FileId = fileId
+}
+
+func (reset *PasswordReset) Usable() bool {
+	return reset.UsedAt.IsZero() && time.Now().Before(reset.ExpiresAt)
+}
+
+// NewResetToken returns a random token to hand to the user along with the
+// hash that gets stored, so a leaked data directory can't be used to reset
+// anybody's password.
+func NewResetToken() (string, string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	return token, HashResetToken(token), nil
+}
+
+func HashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
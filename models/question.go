@@ -0,0 +1,45 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"log/slog"
+	"time"
+)
+
+const (
+	QuestionOpen      = "open"
+	QuestionAnswered  = "answered"
+	QuestionDismissed = "dismissed"
+)
+
+// Question is asked by a visitor whose search came up empty.  It waits in the
+// moderation queue until somebody answers it or dismisses it.
+type Question struct {
+	FileId      string    `json:"-"`
+	Question    string    `json:"question"`
+	Tags        []string  `json:"tags"`
+	Status      string    `json:"status"`
+	Ip          string    `json:"ip"`
+	CreatedAt   time.Time `json:"createdat"`
+	AnswerId    string    `json:"answerid"`
+	HandledById string    `json:"handledbyid"`
+	HandledAt   time.Time `json:"handledat"`
+	HandledBy   string    `json:"-"`
+}
+
+func (question *Question) AfterFind(db *ivy.DB, fileId string) {
+	*question = Question(*question)
+
+	question.FileId = fileId
+
+	if question.HandledById != "" {
+		var handleUser User
+
+		err := db.Find("users", &handleUser, question.HandledById)
+		if err != nil {
+			slog.Error("Could not find handler", "question", fileId, "err", err)
+		}
+
+		question.HandledBy = handleUser.Name
+	}
+}
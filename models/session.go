@@ -0,0 +1,23 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"time"
+)
+
+type Session struct {
+	FileId     string            `json:"-"`
+	TokenHash  string            `json:"tokenhash"`
+	UserId     string            `json:"userid"`
+	Values     map[string]string `json:"values"`
+	Ip         string            `json:"ip"`
+	UserAgent  string            `json:"useragent"`
+	CreatedAt  time.Time         `json:"createdat"`
+	LastSeenAt time.Time         `json:"lastseenat"`
+}
+
+func (session *Session) AfterFind(db *ivy.DB, fileId string) {
+	*session = Session(*session)
+
+	session.FileId = fileId
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Trash is embedded in records that are moved to the trash rather than
+// deleted outright.  A record is in the trash when DeletedAt is set.
+type Trash struct {
+	DeletedAt   time.Time `json:"deletedat"`
+	DeletedById string    `json:"deletedbyid"`
+}
+
+func (trash *Trash) IsDeleted() bool {
+	return !trash.DeletedAt.IsZero()
+}
+
+func (trash *Trash) MoveToTrash(userId string) {
+	trash.DeletedAt = time.Now()
+	trash.DeletedById = userId
+}
+
+func (trash *Trash) Restore() {
+	trash.DeletedAt = time.Time{}
+	trash.DeletedById = ""
+}
+
+func (trash *Trash) TrashInfo() *Trash {
+	return trash
+}
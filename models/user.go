@@ -1,15 +1,44 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
 	"github.com/jameycribbs/ivy"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
 )
 
+const MinPasswordLength = 8
+
+const recoveryCodeCount = 10
+
 type User struct {
-	FileId   string `json:"-"y`
-	Name     string `json:"name"`
-	Login    string `json:"login"`
-	Password []byte `json:"password"`
-	Level    string `json:"level"`
+	FileId        string            `json:"-"`
+	Name          string            `json:"name"`
+	Login         string            `json:"login"`
+	Password      []byte            `json:"password"`
+	Level         string            `json:"level"`
+	Email         string            `json:"email"`
+	AuthSource    string            `json:"authsource"`
+	ExternalId    string            `json:"externalid"`
+	TotpSecret    string            `json:"totpsecret"`
+	TotpEnabled   bool              `json:"totpenabled"`
+	TotpLastStep  int64             `json:"totplaststep"`
+	RecoveryCodes [][]byte          `json:"recoverycodes"`
+	Edition       string            `json:"edition"`
+	Notify        NotificationPrefs `json:"notify"`
+	Trash
+}
+
+// NotificationPrefs says which emails a user wants.  Emails about their own
+// account, such as password reset links, are always sent.
+type NotificationPrefs struct {
+	Questions  bool `json:"questions"`
+	Reviews    bool `json:"reviews"`
+	OwnAnswers bool `json:"ownanswers"`
+	Digest     bool `json:"digest"`
 }
 
 func (user *User) AfterFind(db *ivy.DB, fileId string) {
@@ -17,3 +46,158 @@ func (user *User) AfterFind(db *ivy.DB, fileId string) {
 
 	user.FileId = fileId
 }
+
+// AuditSnapshot is the user as written to the audit log, without the password
+// hash or two-factor secrets.
+func (user User) AuditSnapshot() interface{} {
+	user.Password = nil
+	user.TotpSecret = ""
+	user.RecoveryCodes = nil
+
+	return user
+}
+
+// CanReview reports whether the user may approve, reject and archive answers.
+func (user *User) CanReview() bool {
+	return user.Level == "admin" || user.Level == "editor"
+}
+
+func (user *User) WantsQuestionEmails() bool {
+	return user.Notify.Questions
+}
+
+func (user *User) WantsReviewEmails() bool {
+	return user.CanReview() && user.Notify.Reviews
+}
+
+func (user *User) WantsOwnAnswerEmails() bool {
+	return user.Notify.OwnAnswers
+}
+
+func (user *User) WantsDigest() bool {
+	return user.CanReview() && user.Notify.Digest
+}
+
+func (user *User) PasswordMatches(password string) bool {
+	return bcrypt.CompareHashAndPassword(user.Password, []byte(password)) == nil
+}
+
+func (user *User) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+
+	return nil
+}
+
+func ValidateNewPassword(password string, confirmation string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("Password must be at least %v characters long", MinPasswordLength)
+	}
+
+	if password != confirmation {
+		return errors.New("Password and confirmation do not match")
+	}
+
+	return nil
+}
+
+// UsersWithLogin returns every user whose login is login, ignoring case.
+// Users in the trash are included: their logins stay taken, so that nobody
+// new can be mistaken for them.
+func UsersWithLogin(db *ivy.DB, login string) ([]User, error) {
+	var users []User
+
+	ids, err := db.FindAllIds("users")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		user := User{}
+
+		err = db.Find("users", &user, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.EqualFold(user.Login, login) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// LoginTaken reports whether login belongs to any user other than the one
+// with fileId, which is empty for a new user.
+func LoginTaken(db *ivy.DB, login string, fileId string) (bool, error) {
+	users, err := UsersWithLogin(db, login)
+	if err != nil {
+		return false, err
+	}
+
+	for _, user := range users {
+		if user.FileId != fileId {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GenerateRecoveryCodes replaces any existing recovery codes and returns the
+// new ones in plain text.  Only their hashes are kept on the user.
+func (user *User) GenerateRecoveryCodes() ([]string, error) {
+	var codes []string
+	var hashes [][]byte
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+
+	user.RecoveryCodes = hashes
+
+	return codes, nil
+}
+
+// UseRecoveryCode reports whether code is one of the user's recovery codes and,
+// if so, removes it so it can't be used again.  The caller must save the user.
+func (user *User) UseRecoveryCode(code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	for i, hash := range user.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (user *User) DisableTwoFactor() {
+	user.TotpSecret = ""
+	user.TotpEnabled = false
+	user.TotpLastStep = 0
+	user.RecoveryCodes = nil
+}
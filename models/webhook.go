@@ -0,0 +1,132 @@
+package models
+
+import (
+	"github.com/jameycribbs/ivy"
+	"sort"
+	"time"
+)
+
+// The events a webhook can subscribe to.
+var WebhookEvents = []string{"answer.created", "answer.updated", "answer.deleted", "user.created", "user.updated",
+	"user.deleted"}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a URL that is sent a signed JSON payload whenever one of Events
+// happens.  Secret is the key for the payload's HMAC-SHA256 signature.
+type Webhook struct {
+	FileId      string    `json:"-"`
+	Url         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret"`
+	Active      bool      `json:"active"`
+	CreatedById string    `json:"createdbyid"`
+	CreatedAt   time.Time `json:"createdat"`
+}
+
+func (webhook *Webhook) AfterFind(db *ivy.DB, fileId string) {
+	*webhook = Webhook(*webhook)
+
+	webhook.FileId = fileId
+}
+
+// AuditSnapshot is the webhook as written to the audit log, without its
+// secret.
+func (webhook Webhook) AuditSnapshot() interface{} {
+	webhook.Secret = ""
+
+	return webhook
+}
+
+func (webhook *Webhook) HasEvent(event string) bool {
+	for _, e := range webhook.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wants reports whether the webhook should be sent event.
+func (webhook *Webhook) Wants(event string) bool {
+	return webhook.Active && webhook.HasEvent(event)
+}
+
+// WebhookDelivery is one payload on its way to a webhook.  It stays pending,
+// and is retried at NextAttemptAt, until the webhook answers with a 2xx
+// status or it runs out of attempts.
+type WebhookDelivery struct {
+	FileId         string    `json:"-"`
+	WebhookId      string    `json:"webhookid"`
+	Url            string    `json:"url"`
+	Event          string    `json:"event"`
+	Payload        string    `json:"payload"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `json:"nextattemptat"`
+	LastStatusCode int       `json:"laststatuscode"`
+	LastError      string    `json:"lasterror"`
+	CreatedAt      time.Time `json:"createdat"`
+	DeliveredAt    time.Time `json:"deliveredat"`
+}
+
+func (delivery *WebhookDelivery) AfterFind(db *ivy.DB, fileId string) {
+	*delivery = WebhookDelivery(*delivery)
+
+	delivery.FileId = fileId
+}
+
+// AllWebhooks returns every webhook, oldest first.
+func AllWebhooks(db *ivy.DB) ([]*Webhook, error) {
+	var webhooks []*Webhook
+
+	ids, err := db.FindAllIds("webhooks")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		webhook := Webhook{}
+
+		err = db.Find("webhooks", &webhook, id)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt.Before(webhooks[j].CreatedAt) })
+
+	return webhooks, nil
+}
+
+// AllWebhookDeliveries returns every delivery, newest first.
+func AllWebhookDeliveries(db *ivy.DB) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+
+	ids, err := db.FindAllIds("webhook_deliveries")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		delivery := WebhookDelivery{}
+
+		err = db.Find("webhook_deliveries", &delivery, id)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+
+	return deliveries, nil
+}
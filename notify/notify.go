@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/mailer"
+	"github.com/jameycribbs/pythia/models"
+	"log/slog"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Notifier sends the notification emails.  With no Mailer it does nothing.
+// BaseUrl is used for links in the emails.  It is never guessed from a
+// request, whose Host header the sender controls, so the configuration
+// insists on it when emails are on.  The email templates are read from
+// TemplatesDir.
+type Notifier struct {
+	DB           *ivy.DB
+	Mailer       mailer.Mailer
+	BaseUrl      string
+	TemplatesDir string
+}
+
+// EmailData is what the email templates are rendered with.
+type EmailData struct {
+	User    *models.User
+	BaseUrl string
+	Data    interface{}
+}
+
+// Enabled reports whether emails are actually sent.
+func (n *Notifier) Enabled() bool {
+	return n != nil && n.Mailer != nil
+}
+
+// Notify emails each user in to, apart from actor, using the template
+// <TemplatesDir>/emails/<name>.txt.  Its first line is the subject, as in
+// "Subject: ...", and the rest is the body.  Sending happens in the
+// background; failures are printed rather than returned.
+func (n *Notifier) Notify(actor *models.User, name string, to []*models.User, data interface{}) {
+	if !n.Enabled() {
+		return
+	}
+
+	baseUrl := n.BaseUrl
+
+	var recipients []*models.User
+
+	for _, user := range to {
+		if user != nil && user.Email != "" && (actor == nil || user.FileId != actor.FileId) {
+			recipients = append(recipients, user)
+		}
+	}
+
+	if len(recipients) == 0 {
+		return
+	}
+
+	go func() {
+		for _, user := range recipients {
+			msg, err := render(n.TemplatesDir, name, EmailData{User: user, BaseUrl: baseUrl, Data: data})
+			if err != nil {
+				slog.Error("Could not render email", "template", name, "err", err)
+				return
+			}
+
+			msg.To = []string{user.Email}
+
+			err = n.Mailer.Send(msg)
+			if err != nil {
+				slog.Error("Could not send email", "to", user.Email, "err", err)
+			}
+		}
+	}()
+}
+
+// Subscribers returns the users who have asked for the emails picked out by
+// want.
+func (n *Notifier) Subscribers(want func(user *models.User) bool) []*models.User {
+	var users []*models.User
+
+	if !n.Enabled() {
+		return nil
+	}
+
+	ids, err := n.DB.FindAllIds("users")
+	if err != nil {
+		slog.Error("Could not look up users to email", "err", err)
+		return nil
+	}
+
+	for _, id := range ids {
+		user := models.User{}
+
+		err = n.DB.Find("users", &user, id)
+		if err != nil {
+			slog.Error("Could not look up users to email", "err", err)
+			return nil
+		}
+
+		if !user.IsDeleted() && want(&user) {
+			users = append(users, &user)
+		}
+	}
+
+	return users
+}
+
+// User returns the user with the given id if they want the emails picked out
+// by want, or nil.
+func (n *Notifier) User(userId string, want func(user *models.User) bool) *models.User {
+	var user models.User
+
+	if !n.Enabled() || userId == "" {
+		return nil
+	}
+
+	err := n.DB.Find("users", &user, userId)
+	if err != nil || user.IsDeleted() || !want(&user) {
+		return nil
+	}
+
+	return &user
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func render(templatesDir string, name string, data EmailData) (mailer.Message, error) {
+	var buf bytes.Buffer
+
+	tmpl, err := template.ParseFiles(path.Join(templatesDir, "emails", name+".txt"))
+	if err != nil {
+		return mailer.Message{}, err
+	}
+
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return mailer.Message{}, err
+	}
+
+	parts := strings.SplitN(buf.String(), "\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject:") {
+		return mailer.Message{}, errors.New("email template must start with a Subject: line")
+	}
+
+	return mailer.Message{Subject: strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject:")),
+		Body: strings.TrimLeft(parts[1], "\n")}, nil
+}
@@ -0,0 +1,149 @@
+package oidc_auth
+
+import (
+	"context"
+	"errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jameycribbs/pythia/identity"
+	"golang.org/x/oauth2"
+	"strings"
+)
+
+type Config struct {
+	Name         string
+	IssuerUrl    string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string
+	GroupsClaim  string
+
+	// RoleMapping maps a value of the groups claim to a Pythia level.  When it
+	// is empty the provider doesn't manage levels and new users start as
+	// plain users.
+	RoleMapping map[string]string
+}
+
+type Provider struct {
+	Name     string
+	config   Config
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+type claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// New looks up the provider's endpoints through OpenID Connect discovery on
+// the issuer URL, so any compliant provider (or a mock one on localhost) will
+// do.
+func New(ctx context.Context, config Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, config.IssuerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Name == "" {
+		config.Name = "Single Sign-On"
+	}
+
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	p := Provider{Name: config.Name, config: config}
+
+	p.oauth2 = oauth2.Config{ClientID: config.ClientId, ClientSecret: config.ClientSecret, RedirectURL: config.RedirectUrl,
+		Endpoint: provider.Endpoint(), Scopes: []string{oidc.ScopeOpenID, "profile", "email"}}
+
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: config.ClientId})
+
+	return &p, nil
+}
+
+func (p *Provider) AuthCodeUrl(state string, nonce string, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades the authorization code for tokens, verifies the ID token
+// and turns its claims into an identity.
+func (p *Provider) Exchange(ctx context.Context, code string, nonce string, verifier string) (identity.Identity, error) {
+	var ident identity.Identity
+	var c claims
+	var raw map[string]interface{}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return ident, err
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return ident, errors.New("no id_token in token response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return ident, err
+	}
+
+	if idToken.Nonce != nonce {
+		return ident, errors.New("id_token nonce does not match")
+	}
+
+	err = idToken.Claims(&c)
+	if err != nil {
+		return ident, err
+	}
+
+	err = idToken.Claims(&raw)
+	if err != nil {
+		return ident, err
+	}
+
+	// An address the provider doesn't say it has verified could be anybody's,
+	// so it is neither used to find an account nor stored on one.
+	ident = identity.Identity{Source: "oidc:" + p.config.IssuerUrl, Subject: c.Subject, Name: c.Name,
+		Login: c.PreferredUsername, Email: c.Email, EmailVerified: c.EmailVerified != nil && *c.EmailVerified}
+
+	if ident.Login == "" {
+		ident.Login = strings.SplitN(c.Email, "@", 2)[0]
+	}
+
+	if ident.Login == "" {
+		ident.Login = c.Subject
+	}
+
+	if len(p.config.RoleMapping) > 0 {
+		ident.ManageLevel = true
+		ident.Level = identity.MapRole(p.config.RoleMapping, groups(raw[p.config.GroupsClaim]))
+	}
+
+	return ident, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+// Providers send groups either as a list or, when there is only one, as a
+// plain string.
+func groups(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var gs []string
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				gs = append(gs, s)
+			}
+		}
+		return gs
+	}
+
+	return nil
+}
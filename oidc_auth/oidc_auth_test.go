@@ -0,0 +1,404 @@
+package oidc_auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/identity"
+	"github.com/jameycribbs/pythia/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIdp is an OpenID Connect provider good enough for Provider: it serves
+// discovery and its signing key, and hands out ID tokens for codes issued by
+// authorize, checking the client secret and the PKCE verifier.
+type mockIdp struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]grant
+}
+
+type grant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdp{t: t, key: key, codes: make(map[string]grant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *mockIdp) discovery(w http.ResponseWriter, r *http.Request) {
+	url := idp.server.URL
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                url,
+		"authorization_endpoint":                url + "/authorize",
+		"token_endpoint":                        url + "/token",
+		"jwks_uri":                              url + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (idp *mockIdp) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"alg": "RS256",
+		"use": "sig",
+		"kid": "test",
+		"n":   b64(idp.key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdp) token(w http.ResponseWriter, r *http.Request) {
+	clientId, secret, _ := r.BasicAuth()
+	if clientId == "" {
+		clientId, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+
+	idp.mu.Lock()
+	g, ok := idp.codes[r.FormValue("code")]
+	delete(idp.codes, r.FormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+	if clientId != "pythia" || secret != "secret" || !ok || b64(sum[:]) != g.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer",
+		"expires_in": 300, "id_token": idp.sign(g.claims)})
+}
+
+// authorize stands in for the person logging in at the provider: it checks
+// the authorization URL Pythia sent them to and returns the code the
+// provider would redirect back with.
+func (idp *mockIdp) authorize(authUrl string, claims map[string]interface{}) (state string, code string) {
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	if u.Path != "/authorize" || q.Get("client_id") != "pythia" || q.Get("code_challenge_method") != "S256" ||
+		!strings.Contains(q.Get("scope"), "openid") {
+
+		idp.t.Fatalf("unexpected authorization URL %v", authUrl)
+	}
+
+	all := map[string]interface{}{"iss": idp.server.URL, "aud": "pythia", "sub": "subject-1",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(), "nonce": q.Get("nonce")}
+
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	code = b64([]byte(q.Get("state") + "-code"))
+
+	idp.mu.Lock()
+	idp.codes[code] = grant{challenge: q.Get("code_challenge"), claims: all}
+	idp.mu.Unlock()
+
+	return q.Get("state"), code
+}
+
+func (idp *mockIdp) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestProvider(t *testing.T, idp *mockIdp) *Provider {
+	mapping, err := identity.ParseRoleMapping("pythia-admins=admin,pythia-editors=editor", ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(context.Background(), Config{IssuerUrl: idp.server.URL, ClientId: "pythia", ClientSecret: "secret",
+		RedirectUrl: "https://pythia.example.org/logins/oidc/callback", RoleMapping: mapping})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return p
+}
+
+// login runs the whole authorization code flow for somebody the provider
+// describes with claims.
+func login(t *testing.T, idp *mockIdp, p *Provider, claims map[string]interface{}) (identity.Identity, error) {
+	verifier := "verifier-0123456789-0123456789-0123456789-0123456789"
+
+	state, code := idp.authorize(p.AuthCodeUrl("state-1", "nonce-1", verifier), claims)
+	if state != "state-1" {
+		t.Fatalf("state came back as %q", state)
+	}
+
+	return p.Exchange(context.Background(), code, "nonce-1", verifier)
+}
+
+func newTestDB(t *testing.T) *ivy.DB {
+	dir := t.TempDir()
+
+	for _, name := range []string{"users", "audit", "password_resets", "sessions", "api_tokens", "answers"} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdp(t)
+	p := newTestProvider(t, idp)
+
+	ident, err := login(t, idp, p, map[string]interface{}{"preferred_username": "alice", "name": "Alice Example",
+		"email": "alice@example.org", "email_verified": true, "groups": []string{"staff", "pythia-editors"}})
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	want := identity.Identity{Source: "oidc:" + idp.server.URL, Subject: "subject-1", Login: "alice",
+		Name: "Alice Example", Email: "alice@example.org", EmailVerified: true, Level: "editor", ManageLevel: true}
+
+	if ident != want {
+		t.Errorf("got identity %+v, want %+v", ident, want)
+	}
+}
+
+func TestExchangeRejectsBadTokens(t *testing.T) {
+	idp := newMockIdp(t)
+	p := newTestProvider(t, idp)
+	verifier := "verifier-0123456789-0123456789-0123456789-0123456789"
+
+	_, code := idp.authorize(p.AuthCodeUrl("state-1", "nonce-1", verifier), nil)
+
+	_, err := p.Exchange(context.Background(), code, "nonce-1", verifier+"-wrong")
+	if err == nil {
+		t.Error("Exchange succeeded with the wrong PKCE verifier")
+	}
+
+	_, code = idp.authorize(p.AuthCodeUrl("state-2", "nonce-2", verifier), nil)
+
+	_, err = p.Exchange(context.Background(), code, "nonce-1", verifier)
+	if err == nil {
+		t.Error("Exchange succeeded with another login's nonce")
+	}
+
+	_, code = idp.authorize(p.AuthCodeUrl("state-3", "nonce-3", verifier), map[string]interface{}{"aud": "other"})
+
+	_, err = p.Exchange(context.Background(), code, "nonce-3", verifier)
+	if err == nil {
+		t.Error("Exchange accepted an ID token for another client")
+	}
+}
+
+func TestEmailVerified(t *testing.T) {
+	idp := newMockIdp(t)
+	p := newTestProvider(t, idp)
+
+	tests := []struct {
+		verified interface{}
+		want     bool
+	}{
+		{true, true},
+		{false, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		claims := map[string]interface{}{"email": "alice@example.org"}
+		if tt.verified != nil {
+			claims["email_verified"] = tt.verified
+		}
+
+		ident, err := login(t, idp, p, claims)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+
+		if ident.EmailVerified != tt.want {
+			t.Errorf("email_verified %v gave EmailVerified %v, want %v", tt.verified, ident.EmailVerified, tt.want)
+		}
+	}
+}
+
+func TestLinking(t *testing.T) {
+	idp := newMockIdp(t)
+	p := newTestProvider(t, idp)
+	db := newTestDB(t)
+
+	admin := models.User{Login: "admin", Name: "Admin", Email: "admin@example.org", Level: "admin"}
+
+	adminId, err := db.Create("users", &admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provision := func(claims map[string]interface{}) (*models.User, error) {
+		ident, err := login(t, idp, p, claims)
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+
+		return identity.FindOrProvisionUser(db, nil, ident)
+	}
+
+	// The provider lets people choose their usernames, so a login alone must
+	// never reach the admin's account.
+	_, err = provision(map[string]interface{}{"sub": "mallory", "preferred_username": "admin"})
+	if err != identity.ErrLoginTaken {
+		t.Errorf("matching login: got %v, want ErrLoginTaken", err)
+	}
+
+	// Nor must an address the provider hasn't verified, nor its local part.
+	for _, verified := range []interface{}{false, nil} {
+		claims := map[string]interface{}{"sub": "mallory", "email": "admin@example.org"}
+		if verified != nil {
+			claims["email_verified"] = verified
+		}
+
+		user, err := provision(claims)
+		if err != identity.ErrLoginTaken {
+			t.Errorf("unverified email (%v): got %+v, %v, want ErrLoginTaken", verified, user, err)
+		}
+	}
+
+	user, err := provision(map[string]interface{}{"sub": "mallory", "preferred_username": "mallory",
+		"email": "admin@example.org"})
+	if err != nil {
+		t.Fatalf("new user: %v", err)
+	}
+
+	if user.FileId == adminId || user.Email != "" || user.Level != "" {
+		t.Errorf("unverified email gave %+v, want a new user without it", user)
+	}
+
+	// A verified address links to the existing account and keeps its history.
+	user, err = provision(map[string]interface{}{"sub": "admin-sub", "preferred_username": "someone-else",
+		"email": "Admin@Example.org", "email_verified": true, "groups": "pythia-admins"})
+	if err != nil {
+		t.Fatalf("verified email: %v", err)
+	}
+
+	if user.FileId != adminId || user.ExternalId != "admin-sub" || user.Level != "admin" {
+		t.Errorf("verified email gave %+v, want the admin's account", user)
+	}
+
+	// From then on the subject finds them, and the role mapping sets the level
+	// every time.
+	user, err = provision(map[string]interface{}{"sub": "admin-sub", "groups": []string{"pythia-editors"}})
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+
+	if user.FileId != adminId || user.Level != "editor" {
+		t.Errorf("second login gave %+v, want the admin's account demoted to editor", user)
+	}
+}
+
+func TestLinkWithPassword(t *testing.T) {
+	idp := newMockIdp(t)
+	p := newTestProvider(t, idp)
+	db := newTestDB(t)
+
+	bob := models.User{Login: "bob", Name: "Bob"}
+
+	bobId, err := db.Create("users", &bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob.FileId = bobId
+
+	ident, err := login(t, idp, p, map[string]interface{}{"sub": "bob-sub", "preferred_username": "bob"})
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	_, err = identity.FindOrProvisionUser(db, nil, ident)
+	if err != identity.ErrLoginTaken {
+		t.Fatalf("got %v, want ErrLoginTaken", err)
+	}
+
+	// Bob has now logged in with his password, which proves the account is his.
+	user, err := identity.Link(db, nil, &bob, ident)
+	if err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	if user.AuthSource != ident.Source || user.ExternalId != "bob-sub" {
+		t.Errorf("linked user %+v", user)
+	}
+
+	user, err = identity.FindOrProvisionUser(db, nil, ident)
+	if err != nil || user.FileId != bobId {
+		t.Errorf("after linking got %+v, %v, want bob", user, err)
+	}
+
+	_, err = identity.Link(db, nil, user, ident)
+	if err != identity.ErrAlreadyLinked {
+		t.Errorf("linking again: got %v, want ErrAlreadyLinked", err)
+	}
+}
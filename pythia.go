@@ -1,123 +1,101 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
-	"github.com/jameycribbs/ivy"
-	"github.com/jameycribbs/pythia/global_vars"
-	"github.com/jameycribbs/pythia/handlers/answers_handler"
-	"github.com/jameycribbs/pythia/handlers/logins_handler"
-	"github.com/jameycribbs/pythia/handlers/users_handler"
-	"github.com/jameycribbs/pythia/models"
-	"github.com/justinas/nosurf"
-	"net/http"
+	"github.com/jameycribbs/pythia/admin"
+	"github.com/jameycribbs/pythia/cli"
+	"github.com/jameycribbs/pythia/config"
 	"os"
+	"strings"
 )
 
 func main() {
-	var port string
-
-	hostname, err := os.Hostname()
-	if err != nil {
-		fmt.Println("Error getting hostname:", err)
-	}
-
-	if hostname == "pythia" {
-		port = ":80"
-	} else {
-		port = ":8080"
+	// A bare "pythia", or one followed by flags, runs the server as it always
+	// has.
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		exitOnError(serve(os.Args[1:]))
+		return
 	}
 
-	fieldsToIndex := make(map[string][]string)
-	fieldsToIndex["answers"] = []string{"tags"}
-	fieldsToIndex["users"] = []string{"login"}
-
-	db, err := ivy.OpenDB("data", fieldsToIndex)
-	if err != nil {
-		fmt.Println("Database initialization failed:", err)
+	name := os.Args[1]
+
+	switch {
+	case name == "serve":
+		exitOnError(serve(os.Args[2:]))
+	case name == "config":
+		exitOnError(printConfig(os.Args[2:]))
+	case cli.IsCommand(name):
+		exitOnError(cli.Run(name, os.Args[2:]))
+	case admin.IsCommand(name):
+		exitOnError(admin.Run(name, os.Args[2:]))
+	case name == "help" || name == "-h" || name == "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "pythia: unknown command %v\n\n", name)
+		usage()
+		os.Exit(2)
 	}
-
-	defer db.Close()
-
-	store := sessions.NewCookieStore([]byte("pythia-is-awesome"))
-
-	gv := global_vars.GlobalVars{MyDB: db, SessionStore: store}
-
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
-
-	r := mux.NewRouter()
-	r.HandleFunc("/", makeHandler(answers_handler.Index, &gv)).Methods("GET")
-
-	r.HandleFunc("/answers", makeHandler(answers_handler.Index, &gv)).Methods("GET")
-	r.HandleFunc("/answers/search", makeHandler(answers_handler.Index, &gv)).Methods("POST")
-	r.HandleFunc("/answers/{id:[0-9]+}", makeHandler(answers_handler.View, &gv)).Methods("GET")
-	r.HandleFunc("/answers/new", makeHandler(answers_handler.New, &gv)).Methods("GET")
-	r.HandleFunc("/answers/create", makeHandler(answers_handler.Create, &gv)).Methods("POST")
-	r.HandleFunc("/answers/{id:[0-9]+}/edit", makeHandler(answers_handler.Edit, &gv)).Methods("GET")
-	r.HandleFunc("/answers/update", makeHandler(answers_handler.Update, &gv)).Methods("POST")
-	r.HandleFunc("/answers/{id:[0-9]+}/delete", makeHandler(answers_handler.Delete, &gv)).Methods("GET")
-	r.HandleFunc("/answers/destroy", makeHandler(answers_handler.Destroy, &gv)).Methods("POST")
-
-	r.HandleFunc("/users", makeHandler(users_handler.Index, &gv)).Methods("GET")
-	r.HandleFunc("/users/{id:[0-9]+}", makeHandler(users_handler.View, &gv)).Methods("GET")
-	r.HandleFunc("/users/new", makeHandler(users_handler.New, &gv)).Methods("GET")
-	r.HandleFunc("/users/create", makeHandler(users_handler.Create, &gv)).Methods("POST")
-	r.HandleFunc("/users/{id:[0-9]+}/edit", makeHandler(users_handler.Edit, &gv)).Methods("GET")
-	r.HandleFunc("/users/update", makeHandler(users_handler.Update, &gv)).Methods("POST")
-	r.HandleFunc("/users/{id:[0-9]+}/delete", makeHandler(users_handler.Delete, &gv)).Methods("GET")
-	r.HandleFunc("/users/destroy", makeHandler(users_handler.Destroy, &gv)).Methods("POST")
-
-	r.HandleFunc("/logins/new", makeHandler(logins_handler.New, &gv)).Methods("GET")
-	r.HandleFunc("/logins/create", makeHandler(logins_handler.Create, &gv)).Methods("POST")
-	r.HandleFunc("/logout", makeHandler(logins_handler.Logout, &gv)).Methods("GET")
-
-	http.Handle("/", r)
-
-	csrfHandler := nosurf.New(http.DefaultServeMux)
-
-	csrfHandler.SetFailureHandler(http.HandlerFunc(failHand))
-
-	http.ListenAndServe(port, csrfHandler)
 }
 
-func failHand(w http.ResponseWriter, r *http.Request) {
-	// will return the reason of the failure
-	fmt.Fprintf(w, "%s\n", nosurf.Reason(r))
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: pythia <command> [flags] [arguments]
+
+The web server:
+  serve                       run the web server (the default); see "pythia serve -h"
+  config print                show the settings the server would use, from its
+                              flags, the environment and the config file
+
+Answers (see "pythia <command> -h"):
+  search <tags>               search for answers
+  show <id>                   show one answer
+  add                         add an answer
+  edit <id>                   edit an answer in $EDITOR
+  tags                        list tags
+
+Administration (all take -data; stop the server first for anything that writes):
+  user create                 add a user
+  user list                   list users
+  user set-role <login> <level>
+  user reset-password <login> set a new password and sign the user out
+  reindex                     re-save every indexed record
+  backup [-o file.tar.gz]     archive the data directory
+  restore <file.tar.gz>       unpack a backup into an empty data directory
+  export [-o file.json]       write answers and editions as JSON
+  import -as <login> <file>   add answers and editions from an export
+  fsck                        check the data directory for problems
+`)
 }
 
-func makeHandler(fn func(http.ResponseWriter, *http.Request, string, *global_vars.GlobalVars, *models.User),
-	gv *global_vars.GlobalVars) http.HandlerFunc {
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		currentUser, err := getCurrentUser(r, gv)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		vars := mux.Vars(r)
-
-		fn(w, r, vars["id"], gv, currentUser)
+// printConfig runs "pythia config print", which takes the same flags as the
+// server along with its own.  Problems with the settings are reported after
+// printing them.
+func printConfig(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: pythia config print [-format yaml|toml] [-show-secrets] [server flags]")
 	}
-}
 
-func getCurrentUser(r *http.Request, gv *global_vars.GlobalVars) (*models.User, error) {
-	var user models.User
+	flags := flag.NewFlagSet("pythia config print", flag.ExitOnError)
+	format := flags.String("format", "yaml", "yaml or toml")
+	showSecrets := flags.Bool("show-secrets", false, "print secrets instead of hiding them")
 
-	session, _ := gv.SessionStore.Get(r, "pythia")
-
-	userId, ok := session.Values["user"]
-
-	if !ok {
-		return nil, nil
+	cfg, err := config.Load(flags, args[1:])
+	if err != nil {
+		return err
 	}
 
-	err := gv.MyDB.Find("users", &user, userId.(string))
+	err = config.Print(os.Stdout, cfg, *format, *showSecrets)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &user, nil
+	return cfg.Validate()
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pythia:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,54 @@
+package record_lock
+
+import (
+	"sync"
+)
+
+// Locks serializes changes to individual records.  ivy reads and writes
+// whole records, so two requests that each read a record, change part of it
+// and write it back can lose one of the changes; holding the record's lock
+// from the read to the write prevents that.  Only the locks currently held or
+// waited on are kept.
+type Locks struct {
+	mu    sync.Mutex
+	locks map[string]*lock
+}
+
+type lock struct {
+	mu      sync.Mutex
+	holders int
+}
+
+func New() *Locks {
+	return &Locks{locks: make(map[string]*lock)}
+}
+
+// Lock waits for and takes the lock on the record fileId in collection, and
+// returns the function that releases it:
+//
+//	defer gv.Locks.Lock("answers", fileId)()
+func (l *Locks) Lock(collection string, fileId string) func() {
+	key := collection + "/" + fileId
+
+	l.mu.Lock()
+	rl, ok := l.locks[key]
+	if !ok {
+		rl = &lock{}
+		l.locks[key] = rl
+	}
+	rl.holders++
+	l.mu.Unlock()
+
+	rl.mu.Lock()
+
+	return func() {
+		rl.mu.Unlock()
+
+		l.mu.Lock()
+		rl.holders--
+		if rl.holders == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
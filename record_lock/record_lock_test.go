@@ -0,0 +1,43 @@
+package record_lock
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestLockSerializesChanges(t *testing.T) {
+	locks := New()
+	ids := []string{"1", "2"}
+	counts := make([]int, len(ids))
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 100; i++ {
+		for n, id := range ids {
+			wg.Add(1)
+
+			go func(n int, id string) {
+				defer wg.Done()
+				defer locks.Lock("answers", id)()
+
+				// Read, give the others a chance to run, then write back.
+				count := counts[n]
+				runtime.Gosched()
+				counts[n] = count + 1
+			}(n, id)
+		}
+	}
+
+	wg.Wait()
+
+	for n, id := range ids {
+		if counts[n] != 100 {
+			t.Errorf("record %v counted %v, want 100", id, counts[n])
+		}
+	}
+
+	if len(locks.locks) != 0 {
+		t.Errorf("%v locks left after all were released", len(locks.locks))
+	}
+}
@@ -0,0 +1,42 @@
+package request_info
+
+import (
+	"net/http"
+)
+
+// Recorder is a ResponseWriter that notes the status code and size of the
+// response written through it.
+type Recorder struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int
+
+	wroteHeader bool
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (rec *Recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.Status = status
+		rec.wroteHeader = true
+	}
+
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *Recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+
+	n, err := rec.ResponseWriter.Write(b)
+	rec.Bytes += n
+
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rec *Recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,120 @@
+package request_info
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Route returns the path template of the mux route handling r, e.g.
+// "/answers/{id:[0-9]+}", or "" outside the router.
+func Route(r *http.Request) string {
+	current := mux.CurrentRoute(r)
+	if current == nil {
+		return ""
+	}
+
+	tmpl, err := current.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+
+	return tmpl
+}
+
+// ParseNetworks parses a comma separated list of IP addresses and CIDR
+// networks, e.g. "127.0.0.1, 10.0.0.0/8".
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or network", item)
+			}
+
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or network", item)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// TrustProxies makes ClientIP see through the reverse proxies in proxies.  A
+// request that comes from one of them gets its RemoteAddr from the
+// X-Forwarded-For header, read from the right and skipping the proxies' own
+// addresses, so a client can't pick its address by sending the header itself.
+// Requests from anywhere else are left alone.
+func TrustProxies(next http.Handler, proxies []*net.IPNet) http.Handler {
+	if len(proxies) == 0 {
+		return next
+	}
+
+	trusted := func(ip net.IP) bool {
+		for _, network := range proxies {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := net.ParseIP(ClientIP(r))
+
+		if client != nil && trusted(client) {
+			hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+			for i := len(hops) - 1; i >= 0; i-- {
+				hop := net.ParseIP(strings.TrimSpace(hops[i]))
+				if hop == nil {
+					break
+				}
+
+				client = hop
+
+				if !trusted(hop) {
+					break
+				}
+			}
+
+			r2 := *r
+			r2.RemoteAddr = net.JoinHostPort(client.String(), "0")
+			r = &r2
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
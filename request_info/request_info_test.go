@@ -0,0 +1,57 @@
+package request_info
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustProxies(t *testing.T) {
+	proxies, err := ParseNetworks("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+
+	handler := TrustProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ClientIP(r)
+	}), proxies)
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"203.0.113.5:4000", nil, "203.0.113.5"},
+		{"203.0.113.5:4000", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"127.0.0.1:4000", nil, "127.0.0.1"},
+		{"127.0.0.1:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"127.0.0.1:4000", []string{"6.6.6.6, 198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"127.0.0.1:4000", []string{"6.6.6.6", "198.51.100.7"}, "198.51.100.7"},
+		{"127.0.0.1:4000", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"127.0.0.1:4000", []string{"198.51.100.7, nonsense"}, "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != tt.want {
+			t.Errorf("from %v with X-Forwarded-For %q: client %v, want %v", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestParseNetworksRejectsNonsense(t *testing.T) {
+	for _, s := range []string{"localhost", "10.0.0.0/33", "1.2.3"} {
+		if _, err := ParseNetworks(s); err == nil {
+			t.Errorf("ParseNetworks(%q) succeeded", s)
+		}
+	}
+}
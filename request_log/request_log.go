@@ -0,0 +1,151 @@
+package request_log
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/jameycribbs/pythia/request_info"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Header carries the request id.  One sent by a proxy in front of pythia is
+// kept, so that its log and pythia's can be matched up; otherwise a new one
+// is made.  Either way it is sent back with the response.
+const Header = "X-Request-Id"
+
+type contextKey struct{}
+
+// entry is what the access log line for a request says beyond what can be
+// seen from outside the router.  makeHandler fills in the route and user.
+type entry struct {
+	logger *slog.Logger
+	route  string
+	userId string
+	quiet  bool
+}
+
+// Middleware gives every request an id and a logger tagged with it, and logs
+// the request once it has been answered.  Server errors are logged at error
+// level, requests to Quiet handlers at debug and everything else at info.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(Header)
+		if !validId(id) {
+			id = newId()
+		}
+
+		w.Header().Set(Header, id)
+
+		e := &entry{logger: slog.Default().With("request_id", id)}
+		rec := request_info.NewRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), contextKey{}, e)))
+
+		level := slog.LevelInfo
+		if rec.Status >= 500 {
+			level = slog.LevelError
+		} else if e.quiet {
+			level = slog.LevelDebug
+		}
+
+		// Only the path is logged; query strings can hold tokens.
+		e.logger.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", e.route),
+			slog.Int("status", rec.Status),
+			slog.Int("bytes", rec.Bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user_id", e.userId),
+			slog.String("ip", request_info.ClientIP(r)))
+	})
+}
+
+// Logger returns the logger for r, which tags everything with the request
+// id, or the default logger for a request that didn't come through
+// Middleware.
+func Logger(r *http.Request) *slog.Logger {
+	e, ok := r.Context().Value(contextKey{}).(*entry)
+	if !ok {
+		return slog.Default()
+	}
+
+	return e.logger
+}
+
+// ServerError logs err, tagged with the request id, and answers with a 500.
+// The error itself can give away file paths and record contents, so the
+// response only has the request id, to quote when reporting the problem.
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	Logger(r).Error("Request failed", "err", err)
+
+	msg := "Something went wrong"
+	if id := w.Header().Get(Header); id != "" {
+		msg += " (request " + id + ")"
+	}
+
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// Quiet logs the requests next handles at debug level, for endpoints such as
+// health checks that are polled too often to be worth logging normally.
+func Quiet(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e, ok := r.Context().Value(contextKey{}).(*entry)
+		if ok {
+			e.quiet = true
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetRoute records the route that handled r for its access log line.
+func SetRoute(r *http.Request, route string) {
+	e, ok := r.Context().Value(contextKey{}).(*entry)
+	if ok {
+		e.route = route
+	}
+}
+
+// SetUser records who made r for its access log line.
+func SetUser(r *http.Request, userId string) {
+	e, ok := r.Context().Value(contextKey{}).(*entry)
+	if ok {
+		e.userId = userId
+	}
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func newId() string {
+	b := make([]byte, 8)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// validId keeps ids from a proxy short and plain, so that they can't be used
+// to forge lines in a text log.
+func validId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' &&
+			c != '.' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,32 @@
+package request_log
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerErrorHidesTheError(t *testing.T) {
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServerError(w, r, errors.New("open /srv/pythia/data/users/12.json: permission denied"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/answers/12", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status %v, want 500", w.Code)
+	}
+
+	body := w.Body.String()
+
+	if strings.Contains(body, "/srv/pythia") {
+		t.Errorf("error sent to the client: %q", body)
+	}
+
+	if id := w.Header().Get(Header); id == "" || !strings.Contains(body, id) {
+		t.Errorf("body %q doesn't have the request id %q", body, id)
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/admin"
+	"github.com/jameycribbs/pythia/audit"
+	"github.com/jameycribbs/pythia/authenticators"
+	"github.com/jameycribbs/pythia/challenge"
+	"github.com/jameycribbs/pythia/config"
+	"github.com/jameycribbs/pythia/data_lock"
+	"github.com/jameycribbs/pythia/global_vars"
+	"github.com/jameycribbs/pythia/handlers/accounts_handler"
+	"github.com/jameycribbs/pythia/handlers/answers_handler"
+	"github.com/jameycribbs/pythia/handlers/api_handler"
+	"github.com/jameycribbs/pythia/handlers/audit_handler"
+	"github.com/jameycribbs/pythia/handlers/chat_handler"
+	"github.com/jameycribbs/pythia/handlers/comments_handler"
+	"github.com/jameycribbs/pythia/handlers/editions_handler"
+	"github.com/jameycribbs/pythia/handlers/lockouts_handler"
+	"github.com/jameycribbs/pythia/handlers/logins_handler"
+	"github.com/jameycribbs/pythia/handlers/oidc_handler"
+	"github.com/jameycribbs/pythia/handlers/password_resets_handler"
+	"github.com/jameycribbs/pythia/handlers/questions_handler"
+	"github.com/jameycribbs/pythia/handlers/trash_handler"
+	"github.com/jameycribbs/pythia/handlers/users_handler"
+	"github.com/jameycribbs/pythia/handlers/webhooks_handler"
+	"github.com/jameycribbs/pythia/health"
+	"github.com/jameycribbs/pythia/https"
+	"github.com/jameycribbs/pythia/login_throttle"
+	"github.com/jameycribbs/pythia/mailer"
+	"github.com/jameycribbs/pythia/metrics"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/notify"
+	"github.com/jameycribbs/pythia/oidc_auth"
+	"github.com/jameycribbs/pythia/record_lock"
+	"github.com/jameycribbs/pythia/request_info"
+	"github.com/jameycribbs/pythia/request_log"
+	"github.com/jameycribbs/pythia/session_store"
+	"github.com/jameycribbs/pythia/stale"
+	"github.com/jameycribbs/pythia/trash"
+	"github.com/jameycribbs/pythia/webhooks"
+	"github.com/justinas/nosurf"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve runs the web server until it is sent SIGINT or SIGTERM, then lets
+// the requests in progress finish and closes the database.  It returns an
+// error when the server can't start or stops by itself.
+func serve(args []string) error {
+	cfg, err := config.Load(flag.NewFlagSet("pythia serve", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(newLogger(cfg.Log))
+
+	db, err := ivy.OpenDB(cfg.DataDir, models.FieldsToIndex())
+	if err != nil {
+		return fmt.Errorf("could not open the database in %v: %v", cfg.DataDir, err)
+	}
+	defer db.Close()
+
+	// Holding the lock until the server stops keeps the admin commands and
+	// the command-line client from writing behind its back.
+	lock, err := data_lock.Acquire(cfg.DataDir)
+	if err != nil {
+		return fmt.Errorf("could not lock %v: %v", cfg.DataDir, err)
+	}
+	defer lock.Release()
+
+	// ctx is cancelled by SIGINT or SIGTERM, which stops the background jobs;
+	// jobs lets shutdown wait for any that are part way through.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var jobs sync.WaitGroup
+
+	var sessionKeys [][]byte
+
+	if cfg.Session.Keys != "" {
+		sessionKeys, err = session_store.ParseKeys(cfg.Session.Keys, "session keys")
+	} else {
+		sessionKeys, err = session_store.LoadKeys(cfg.Session.KeysFile)
+	}
+	if err != nil {
+		return fmt.Errorf("could not load session keys: %v", err)
+	}
+
+	store := session_store.New(db, cfg.Session.IdleTimeout, cfg.Session.MaxAge, sessionKeys...)
+	store.Options.Secure = cfg.CookiesSecure()
+	store.Options.Domain = cfg.Session.CookieDomain
+	store.Options.SameSite = sameSite(cfg.Session.CookieSameSite)
+
+	every(ctx, &jobs, time.Hour, func() {
+		err := store.DeleteExpired()
+		if err != nil {
+			slog.Error("Could not delete expired sessions", "err", err)
+		}
+	})
+
+	// Logins get a few free tries and are locked out after 10 failures; an IP
+	// address may be shared by a whole club, so it is given more room.
+	loginThrottle := login_throttle.New(3, 10, time.Second, 5*time.Minute, 15*time.Minute)
+	ipThrottle := login_throttle.New(10, 50, time.Second, 5*time.Minute, time.Hour)
+
+	// Visitors can ask a few questions in a row before having to wait, and
+	// an address is forgotten after a quiet day.
+	questionThrottle := login_throttle.New(3, 20, time.Minute, time.Hour, 24*time.Hour)
+
+	questionChallenge, err := challenge.New(3*time.Second, time.Hour)
+	if err != nil {
+		return fmt.Errorf("could not set up the question challenge: %v", err)
+	}
+
+	var oidcProvider *oidc_auth.Provider
+
+	if cfg.Oidc.IssuerUrl != "" {
+		oidcProvider, err = oidc_auth.New(ctx, cfg.OidcConfig())
+		if err != nil {
+			return fmt.Errorf("could not set up single sign-on: %v", err)
+		}
+	}
+
+	if cfg.TrashRetention > 0 {
+		every(ctx, &jobs, time.Hour, func() {
+			purged, err := trash.PurgeExpired(db, cfg.TrashRetention)
+			if err != nil {
+				slog.Error("Could not empty the trash", "err", err)
+			}
+
+			for _, item := range purged {
+				audit.Record(db, nil, audit.Event{ActorLogin: "system", Action: "purge", Collection: item.Collection,
+					TargetId: item.FileId, Detail: "retention period expired"})
+			}
+		})
+	}
+
+	notifier := &notify.Notifier{DB: db, BaseUrl: strings.TrimSuffix(cfg.BaseUrl, "/"), TemplatesDir: cfg.TemplatesDir}
+
+	if cfg.Mail.Outbox != "" {
+		notifier.Mailer = &mailer.Outbox{Dir: cfg.Mail.Outbox, From: cfg.Mail.From}
+	} else if cfg.Mail.SmtpAddr != "" {
+		notifier.Mailer = mailer.Smtp{Addr: cfg.Mail.SmtpAddr, Username: cfg.Mail.SmtpUsername,
+			Password: cfg.Mail.SmtpPassword, From: cfg.Mail.From}
+	}
+
+	staleTracker := stale.New(db, cfg.VerifyInterval)
+
+	digestSentPath := filepath.Join(cfg.DataDir, "digest_sent")
+
+	digestSent, err := stale.LoadDigestSent(digestSentPath)
+	if err != nil {
+		slog.Error("Could not read when the digest last went out", "err", err)
+	}
+
+	every(ctx, &jobs, time.Hour, func() {
+		err := staleTracker.Refresh()
+		if err != nil {
+			slog.Error("Could not look for overdue answers", "err", err)
+			return
+		}
+
+		// The digest goes out on Monday mornings.
+		now := time.Now()
+		if now.Weekday() != time.Monday || now.Hour() < 8 || now.Sub(digestSent) < 24*time.Hour {
+			return
+		}
+
+		if notifier.Enabled() {
+			answers, err := staleTracker.Overdue()
+			if err != nil {
+				slog.Error("Could not build the overdue answers digest", "err", err)
+				return
+			}
+
+			if len(answers) > 0 {
+				notifier.Notify(nil, "stale_digest", notifier.Subscribers((*models.User).WantsDigest), answers)
+			}
+		} else {
+			digest, count, err := staleTracker.Digest()
+			if err != nil {
+				slog.Error("Could not build the overdue answers digest", "err", err)
+				return
+			}
+
+			if count > 0 {
+				slog.Info("Answers are overdue for checking", "count", count, "digest", digest)
+			}
+		}
+
+		digestSent = now
+
+		err = stale.SaveDigestSent(digestSentPath, digestSent)
+		if err != nil {
+			slog.Error("Could not record that the digest went out", "err", err)
+		}
+	})
+
+	dispatcher := webhooks.New(db)
+
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		dispatcher.Run(ctx)
+	}()
+
+	authenticator := authenticators.Chain{authenticators.Local{DB: db}}
+
+	if cfg.Ldap.Url != "" {
+		ldapAuthenticator, err := authenticators.NewLdap(cfg.LdapConfig(), db)
+		if err != nil {
+			return fmt.Errorf("could not set up LDAP: %v", err)
+		}
+
+		ldapAuthenticator.Webhooks = dispatcher
+		authenticator = append(authenticator, ldapAuthenticator)
+	}
+
+	gv := global_vars.GlobalVars{MyDB: db, SessionStore: store, LoginThrottle: loginThrottle, IpThrottle: ipThrottle,
+		Authenticator: authenticator, Oidc: oidcProvider, TemplatesDir: cfg.TemplatesDir,
+		RequireAdminTwoFactor: cfg.Features.RequireAdminTwoFactor, TrashRetention: cfg.TrashRetention,
+		QuestionThrottle: questionThrottle, Challenge: questionChallenge, Stale: staleTracker, Notifier: notifier,
+		Webhooks: dispatcher, ChatSigningSecret: cfg.Chat.SigningSecret, ChatToken: cfg.Chat.Token,
+		Locks: record_lock.New()}
+
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
+	http.Handle("/static/", http.StripPrefix("/static/", fs))
+
+	// For the load balancer or orchestrator: /healthz says the process is up,
+	// /readyz that it can reach its data.
+	http.Handle("/healthz", request_log.Quiet(http.HandlerFunc(health.Live)))
+	http.Handle("/readyz", request_log.Quiet(&health.Ready{DB: db, DataDir: cfg.DataDir, Collections: admin.Collections()}))
+
+	r := mux.NewRouter()
+	r.Use(metrics.Middleware)
+
+	r.HandleFunc("/", makeHandler(answers_handler.Index, &gv)).Methods("GET")
+
+	r.HandleFunc("/answers", makeHandler(answers_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/answers/search", makeHandler(answers_handler.Index, &gv)).Methods("POST")
+	r.HandleFunc("/answers/{id:[0-9]+}", makeHandler(answers_handler.View, &gv)).Methods("GET")
+	r.HandleFunc("/answers/new", makeHandler(answers_handler.New, &gv)).Methods("GET")
+	r.HandleFunc("/answers/create", makeHandler(answers_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/answers/{id:[0-9]+}/edit", makeHandler(answers_handler.Edit, &gv)).Methods("GET")
+	r.HandleFunc("/answers/update", makeHandler(answers_handler.Update, &gv)).Methods("POST")
+	r.HandleFunc("/answers/{id:[0-9]+}/delete", makeHandler(answers_handler.Delete, &gv)).Methods("GET")
+	r.HandleFunc("/answers/destroy", makeHandler(answers_handler.Destroy, &gv)).Methods("POST")
+	r.HandleFunc("/answers/review", makeHandler(answers_handler.Review, &gv)).Methods("GET")
+	r.HandleFunc("/answers/low_scores", makeHandler(answers_handler.LowScores, &gv)).Methods("GET")
+	r.HandleFunc("/answers/vote", makeHandler(answers_handler.Vote, &gv)).Methods("POST")
+	r.HandleFunc("/answers/stale", makeHandler(answers_handler.Stale, &gv)).Methods("GET")
+	r.HandleFunc("/answers/verify", makeHandler(answers_handler.Verify, &gv)).Methods("POST")
+	r.HandleFunc("/answers/clear_review_flag", makeHandler(answers_handler.ClearReviewFlag, &gv)).Methods("POST")
+	r.HandleFunc("/answers/submit", makeHandler(answers_handler.Submit, &gv)).Methods("POST")
+	r.HandleFunc("/answers/approve", makeHandler(answers_handler.Approve, &gv)).Methods("POST")
+	r.HandleFunc("/answers/reject", makeHandler(answers_handler.Reject, &gv)).Methods("POST")
+	r.HandleFunc("/answers/archive", makeHandler(answers_handler.Archive, &gv)).Methods("POST")
+
+	r.HandleFunc("/users", makeHandler(users_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", makeHandler(users_handler.View, &gv)).Methods("GET")
+	r.HandleFunc("/users/new", makeHandler(users_handler.New, &gv)).Methods("GET")
+	r.HandleFunc("/users/create", makeHandler(users_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/edit", makeHandler(users_handler.Edit, &gv)).Methods("GET")
+	r.HandleFunc("/users/update", makeHandler(users_handler.Update, &gv)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/delete", makeHandler(users_handler.Delete, &gv)).Methods("GET")
+	r.HandleFunc("/users/destroy", makeHandler(users_handler.Destroy, &gv)).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/reset_password", makeHandler(users_handler.ResetPassword, &gv)).Methods("GET")
+	r.HandleFunc("/users/create_password_reset", makeHandler(users_handler.CreatePasswordReset, &gv)).Methods("POST")
+	r.HandleFunc("/users/disable_two_factor", makeHandler(users_handler.DisableTwoFactor, &gv)).Methods("POST")
+
+	r.HandleFunc("/account", makeHandler(accounts_handler.View, &gv)).Methods("GET")
+	r.HandleFunc("/account/edition", makeHandler(accounts_handler.UpdateEdition, &gv)).Methods("POST")
+	r.HandleFunc("/account/notifications", makeHandler(accounts_handler.UpdateNotifications, &gv)).Methods("POST")
+	r.HandleFunc("/account/password", makeHandler(accounts_handler.EditPassword, &gv)).Methods("GET")
+	r.HandleFunc("/account/password/update", makeHandler(accounts_handler.UpdatePassword, &gv)).Methods("POST")
+	r.HandleFunc("/account/two_factor", makeHandler(accounts_handler.TwoFactor, &gv)).Methods("GET")
+	r.HandleFunc("/account/two_factor/enable", makeHandler(accounts_handler.EnableTwoFactor, &gv)).Methods("POST")
+	r.HandleFunc("/account/two_factor/disable", makeHandler(accounts_handler.DisableTwoFactor, &gv)).Methods("POST")
+	r.HandleFunc("/account/two_factor/recovery_codes", makeHandler(accounts_handler.RegenerateRecoveryCodes, &gv)).Methods("POST")
+	r.HandleFunc("/account/sessions", makeHandler(accounts_handler.Sessions, &gv)).Methods("GET")
+	r.HandleFunc("/account/sessions/revoke", makeHandler(accounts_handler.RevokeSession, &gv)).Methods("POST")
+	r.HandleFunc("/account/sessions/revoke_others", makeHandler(accounts_handler.RevokeOtherSessions, &gv)).Methods("POST")
+
+	r.HandleFunc("/password_resets/edit", makeHandler(password_resets_handler.Edit, &gv)).Methods("GET")
+	r.HandleFunc("/password_resets/update", makeHandler(password_resets_handler.Update, &gv)).Methods("POST")
+
+	r.HandleFunc("/logins/new", makeHandler(logins_handler.New, &gv)).Methods("GET")
+	r.HandleFunc("/logins/create", makeHandler(logins_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/logins/two_factor", makeHandler(logins_handler.TwoFactor, &gv)).Methods("GET")
+	r.HandleFunc("/logins/two_factor/verify", makeHandler(logins_handler.VerifyTwoFactor, &gv)).Methods("POST")
+	r.HandleFunc("/logins/oidc", makeHandler(oidc_handler.Login, &gv)).Methods("GET")
+	r.HandleFunc("/logins/oidc/callback", makeHandler(oidc_handler.Callback, &gv)).Methods("GET")
+	r.HandleFunc("/logout", makeHandler(logins_handler.Logout, &gv)).Methods("GET")
+
+	r.HandleFunc("/comments/create", makeHandler(comments_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/comments/{id:[0-9]+}/edit", makeHandler(comments_handler.Edit, &gv)).Methods("GET")
+	r.HandleFunc("/comments/update", makeHandler(comments_handler.Update, &gv)).Methods("POST")
+	r.HandleFunc("/comments/hide", makeHandler(comments_handler.Hide, &gv)).Methods("POST")
+	r.HandleFunc("/comments/destroy", makeHandler(comments_handler.Destroy, &gv)).Methods("POST")
+
+	r.HandleFunc("/questions", makeHandler(questions_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/questions/new", makeHandler(questions_handler.New, &gv)).Methods("GET")
+	r.HandleFunc("/questions/create", makeHandler(questions_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/questions/{id:[0-9]+}/answer", makeHandler(questions_handler.Answer, &gv)).Methods("GET")
+	r.HandleFunc("/questions/answer", makeHandler(questions_handler.CreateAnswer, &gv)).Methods("POST")
+	r.HandleFunc("/questions/dismiss", makeHandler(questions_handler.Dismiss, &gv)).Methods("POST")
+
+	r.HandleFunc("/editions", makeHandler(editions_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/editions/create", makeHandler(editions_handler.Create, &gv)).Methods("POST")
+
+	r.HandleFunc("/account/api_tokens", makeHandler(accounts_handler.ApiTokens, &gv)).Methods("GET")
+	r.HandleFunc("/account/api_tokens/create", makeHandler(accounts_handler.CreateApiToken, &gv)).Methods("POST")
+	r.HandleFunc("/account/api_tokens/revoke", makeHandler(accounts_handler.RevokeApiToken, &gv)).Methods("POST")
+
+	if cfg.Features.Api {
+		r.HandleFunc("/api/answers", makeApiHandler(api_handler.Search, &gv)).Methods("GET")
+		r.HandleFunc("/api/answers", makeApiHandler(api_handler.Create, &gv)).Methods("POST")
+		r.HandleFunc("/api/answers/{id:[0-9]+}", makeApiHandler(api_handler.Show, &gv)).Methods("GET")
+		r.HandleFunc("/api/answers/{id:[0-9]+}", makeApiHandler(api_handler.Update, &gv)).Methods("PUT")
+		r.HandleFunc("/api/tags", makeApiHandler(api_handler.Tags, &gv)).Methods("GET")
+	}
+
+	r.HandleFunc("/chat/command", makeHandler(chat_handler.Command, &gv)).Methods("POST")
+
+	r.HandleFunc("/webhooks", makeHandler(webhooks_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/webhooks/create", makeHandler(webhooks_handler.Create, &gv)).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/edit", makeHandler(webhooks_handler.Edit, &gv)).Methods("GET")
+	r.HandleFunc("/webhooks/update", makeHandler(webhooks_handler.Update, &gv)).Methods("POST")
+	r.HandleFunc("/webhooks/destroy", makeHandler(webhooks_handler.Destroy, &gv)).Methods("POST")
+	r.HandleFunc("/webhooks/deliveries", makeHandler(webhooks_handler.Deliveries, &gv)).Methods("GET")
+	r.HandleFunc("/webhooks/redeliver", makeHandler(webhooks_handler.Redeliver, &gv)).Methods("POST")
+
+	r.HandleFunc("/trash", makeHandler(trash_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/trash/restore", makeHandler(trash_handler.Restore, &gv)).Methods("POST")
+	r.HandleFunc("/trash/purge", makeHandler(trash_handler.Purge, &gv)).Methods("POST")
+
+	r.HandleFunc("/audit", makeHandler(audit_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/audit/export", makeHandler(audit_handler.Export, &gv)).Methods("GET")
+
+	r.HandleFunc("/lockouts", makeHandler(lockouts_handler.Index, &gv)).Methods("GET")
+	r.HandleFunc("/lockouts/unlock", makeHandler(lockouts_handler.Unlock, &gv)).Methods("POST")
+
+	http.Handle("/", r)
+
+	csrfHandler := nosurf.New(http.DefaultServeMux)
+
+	// Slash commands come from the chat server, not a form, and are checked
+	// by their signature or token instead.
+	csrfHandler.ExemptPath("/chat/command")
+
+	// The JSON API is authenticated by a token in the Authorization header,
+	// which a cross-site form can't send.
+	csrfHandler.ExemptRegexp("^/api/")
+
+	csrfHandler.SetFailureHandler(http.HandlerFunc(failHand))
+
+	csrfHandler.SetBaseCookie(http.Cookie{Path: "/", Domain: cfg.Session.CookieDomain, MaxAge: nosurf.MaxAge,
+		Secure: cfg.CookiesSecure(), HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	// Everything, including requests turned away by the CSRF check, gets a
+	// request id and a line in the access log.
+	var handler http.Handler = request_log.Middleware(csrfHandler)
+
+	// Behind a reverse proxy every request comes from the proxy, and the
+	// client's own address is in X-Forwarded-For.
+	trustedProxies, _ := request_info.ParseNetworks(cfg.Http.TrustedProxies)
+	handler = request_info.TrustProxies(handler, trustedProxies)
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	server := newServer(cfg.Http, handler)
+
+	var servers []*http.Server
+
+	serverErrs := make(chan error, 3)
+
+	if cfg.TlsEnabled() {
+		certs, err := https.NewReloader(cfg.Tls.CertFile, cfg.Tls.KeyFile)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("could not load the TLS certificate: %v", err)
+		}
+
+		// A renewed certificate is picked up when its files change, or straight
+		// away on SIGHUP.
+		go certs.Watch(time.Minute)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		go func() {
+			for range hup {
+				err := certs.Reload()
+				if err != nil {
+					slog.Error("Could not reload the TLS certificate", "err", err)
+					continue
+				}
+
+				slog.Info("Reloaded the TLS certificate", "file", cfg.Tls.CertFile)
+			}
+		}()
+
+		if cfg.Tls.HstsMaxAge > 0 {
+			server.Handler = https.Hsts(handler, cfg.Tls.HstsMaxAge, cfg.Tls.HstsIncludeSubdomains)
+		}
+
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+
+		if cfg.Tls.RedirectFrom != "" {
+			redirectLn, err := net.Listen("tcp", cfg.Tls.RedirectFrom)
+			if err != nil {
+				ln.Close()
+				return err
+			}
+
+			redirect := newServer(cfg.Http, https.Redirect(cfg.Listen))
+			servers = append(servers, redirect)
+
+			go func() { serverErrs <- redirect.Serve(redirectLn) }()
+		}
+
+		go func() { serverErrs <- server.ServeTLS(ln, "", "") }()
+	} else {
+		go func() { serverErrs <- server.Serve(ln) }()
+	}
+
+	servers = append(servers, server)
+
+	slog.Info("Listening", "addr", cfg.Listen, "tls", cfg.TlsEnabled())
+
+	// Metrics give away how busy the site is and who is failing to log in, so
+	// they are only served on an address of their own, for the scraper.
+	if cfg.MetricsListen != "" {
+		metricsServer, err := serveMetrics(cfg, db, serverErrs)
+		if err != nil {
+			// Shut down the server started above the same way as if it failed.
+			serverErrs <- err
+		} else {
+			servers = append(servers, metricsServer)
+		}
+	}
+
+	select {
+	case err = <-serverErrs:
+		err = fmt.Errorf("server stopped: %v", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+
+	stop()
+
+	// Requests in progress and background jobs part way through get until
+	// the shutdown timeout to finish before the database is closed under them.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Http.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		shutdownErr := srv.Shutdown(shutdownCtx)
+		if shutdownErr != nil {
+			slog.Error("Could not finish the requests in progress", "err", shutdownErr)
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		slog.Warn("Gave up waiting for background jobs to finish")
+	}
+
+	return err
+}
+
+// serveMetrics serves Prometheus metrics at /metrics on cfg.MetricsListen,
+// sending the error to serverErrs if the server stops.
+func serveMetrics(cfg *config.Config, db *ivy.DB, serverErrs chan error) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.MetricsListen)
+	if err != nil {
+		return nil, fmt.Errorf("could not serve metrics: %v", err)
+	}
+
+	metrics.CountRecords(db, admin.Collections())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", request_log.Quiet(metrics.Handler()))
+
+	server := newServer(cfg.Http, request_log.Middleware(mux))
+
+	go func() { serverErrs <- server.Serve(ln) }()
+
+	slog.Info("Serving metrics", "addr", cfg.MetricsListen)
+
+	return server, nil
+}
+
+// newServer is an http.Server with the configured timeouts, so that slow or
+// idle clients can't hold connections open for ever.
+func newServer(cfg config.Http, handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler, ReadHeaderTimeout: cfg.ReadHeaderTimeout, ReadTimeout: cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout, IdleTimeout: cfg.IdleTimeout}
+}
+
+// every runs job straight away and then every interval until ctx is done.  It
+// is counted in jobs while it runs.
+func every(ctx context.Context, jobs *sync.WaitGroup, interval time.Duration, job func()) {
+	jobs.Add(1)
+
+	go func() {
+		defer jobs.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			job()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// newLogger sets up the server's log from the log settings.  It also becomes
+// where the standard library's log package writes.
+func newLogger(cfg config.Log) *slog.Logger {
+	var level slog.Level
+
+	level.UnmarshalText([]byte(cfg.Level))
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+func sameSite(s string) http.SameSite {
+	switch s {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+func failHand(w http.ResponseWriter, r *http.Request) {
+	request_log.Logger(r).Warn("CSRF check failed", "reason", nosurf.Reason(r))
+
+	// will return the reason of the failure
+	fmt.Fprintf(w, "%s\n", nosurf.Reason(r))
+}
+
+func makeHandler(fn func(http.ResponseWriter, *http.Request, string, *global_vars.GlobalVars, *models.User),
+	gv *global_vars.GlobalVars) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		request_log.SetRoute(r, request_info.Route(r))
+
+		currentUser, err := getCurrentUser(r, gv)
+		if err != nil {
+			request_log.ServerError(w, r, fmt.Errorf("could not find the session's user: %v", err))
+			return
+		}
+
+		if currentUser != nil {
+			request_log.SetUser(r, currentUser.FileId)
+		}
+
+		// Under the admin 2FA policy an admin who hasn't enrolled yet can do
+		// nothing but enroll or log out.
+		if gv.RequireAdminTwoFactor && (currentUser != nil) && (currentUser.Level == "admin") &&
+			!currentUser.TotpEnabled && !strings.HasPrefix(r.URL.Path, "/account/two_factor") &&
+			(r.URL.Path != "/logout") {
+
+			http.Redirect(w, r, "/account/two_factor", http.StatusFound)
+			return
+		}
+
+		vars := mux.Vars(r)
+
+		fn(w, r, vars["id"], gv, currentUser)
+	}
+}
+
+// makeApiHandler is makeHandler for the JSON API, which identifies the user by
+// an "Authorization: Bearer <token>" header instead of the session cookie.
+func makeApiHandler(fn func(http.ResponseWriter, *http.Request, string, *global_vars.GlobalVars, *models.User),
+	gv *global_vars.GlobalVars) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		request_log.SetRoute(r, request_info.Route(r))
+
+		currentUser, err := getApiUser(r, gv)
+		if err != nil {
+			request_log.Logger(r).Warn("Refused an API token", "err", err)
+			api_handler.Unauthorized(w)
+			return
+		}
+
+		if currentUser != nil {
+			request_log.SetUser(r, currentUser.FileId)
+		}
+
+		vars := mux.Vars(r)
+
+		fn(w, r, vars["id"], gv, currentUser)
+	}
+}
+
+// getApiUser returns the owner of the request's API token, or nil when there
+// is no token.
+func getApiUser(r *http.Request, gv *global_vars.GlobalVars) (*models.User, error) {
+	var token models.ApiToken
+	var user models.User
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, errors.New("not a bearer token")
+	}
+
+	id, err := gv.MyDB.FindFirstIdForField("api_tokens", "tokenhash",
+		models.HashResetToken(strings.TrimPrefix(header, "Bearer ")))
+	if err != nil {
+		return nil, err
+	}
+
+	err = gv.MyDB.Find("api_tokens", &token, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gv.MyDB.Find("users", &user, token.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.IsDeleted() {
+		return nil, errors.New("user has been deleted")
+	}
+
+	// Only note the last use now and then rather than on every request.
+	if time.Since(token.LastUsedAt) > time.Hour {
+		token.LastUsedAt = time.Now()
+
+		err = gv.MyDB.Update("api_tokens", token, id)
+		if err != nil {
+			request_log.Logger(r).Error("Could not update API token", "err", err)
+		}
+	}
+
+	return &user, nil
+}
+
+func getCurrentUser(r *http.Request, gv *global_vars.GlobalVars) (*models.User, error) {
+	var user models.User
+
+	session, _ := gv.SessionStore.Get(r, "pythia")
+
+	userId, ok := session.Values["user"]
+
+	if !ok {
+		return nil, nil
+	}
+
+	err := gv.MyDB.Find("users", &user, userId.(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if user.IsDeleted() {
+		return nil, nil
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,382 @@
+package session_store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"github.com/jameycribbs/pythia/request_info"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNotFound = errors.New("session not found")
+
+// Last-seen times are only written back this often, so that browsing around
+// doesn't rewrite the session file on every request.
+const touchInterval = time.Minute
+
+// Store keeps sessions in the "sessions" collection.  The cookie only carries
+// a random token, signed and encrypted with the configured keys; the record
+// is looked up by the token's hash.  The session's ID is the token itself.
+//
+// Session values are stored as strings.
+type Store struct {
+	db              *ivy.DB
+	Codecs          []securecookie.Codec
+	Options         *sessions.Options
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+}
+
+// New returns a store using keyPairs in the order expected by
+// securecookie.CodecsFromPairs: a hash key and block key for the current
+// cookie key, followed by any older pairs that are still accepted.
+func New(db *ivy.DB, idleTimeout time.Duration, absoluteTimeout time.Duration, keyPairs ...[]byte) *Store {
+	return &Store{
+		db:     db,
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", MaxAge: int(absoluteTimeout / time.Second), HttpOnly: true,
+			SameSite: http.SameSiteLaxMode},
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+	}
+}
+
+// LoadKeys reads cookie keys from path, one base64 encoded 64 byte key per
+// line, newest first.  Each key is split into a signing half and an encryption
+// half.  To rotate, add a new key at the top and remove the old one once
+// sessions created with it have expired.  If the file doesn't exist a key is
+// generated and written to it.
+func LoadKeys(path string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := securecookie.GenerateRandomKey(64)
+		if key == nil {
+			return nil, errors.New("could not generate session key")
+		}
+
+		data = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeys(string(data), path)
+}
+
+// ParseKeys reads cookie keys in the format of the keys file from data, where
+// commas may also separate keys.  source names where they came from in
+// errors.
+func ParseKeys(data string, source string) ([][]byte, error) {
+	var keyPairs [][]byte
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, encoded := range strings.Split(line, ",") {
+			key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+			if err != nil || len(key) != 64 {
+				return nil, fmt.Errorf("%v: each key must be 64 bytes, base64 encoded", source)
+			}
+
+			keyPairs = append(keyPairs, key[:32], key[32:])
+		}
+	}
+
+	if len(keyPairs) == 0 {
+		return nil, fmt.Errorf("%v: no session keys", source)
+	}
+
+	return keyPairs, nil
+}
+
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+
+	err = securecookie.DecodeMulti(name, c.Value, &token, s.Codecs...)
+	if err != nil {
+		// A cookie we can't read (tampered with, or signed with a key that
+		// has since been retired) just means starting a new session.
+		return session, nil
+	}
+
+	rec, err := s.find(token)
+	if err != nil {
+		return session, nil
+	}
+
+	now := time.Now()
+
+	if s.expired(rec, now) {
+		s.db.Delete("sessions", rec.FileId)
+		return session, nil
+	}
+
+	if now.Sub(rec.LastSeenAt) > touchInterval {
+		rec.LastSeenAt = now
+		s.db.Update("sessions", rec, rec.FileId)
+	}
+
+	session.ID = token
+	session.IsNew = false
+
+	for k, v := range rec.Values {
+		session.Values[k] = v
+	}
+
+	return session, nil
+}
+
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			rec, err := s.find(session.ID)
+			if err == nil {
+				s.db.Delete("sessions", rec.FileId)
+			}
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	values := make(map[string]string)
+	for k, v := range session.Values {
+		values[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+
+	now := time.Now()
+
+	rec, err := s.find(session.ID)
+	if err == nil {
+		rec.UserId = values["user"]
+		rec.Values = values
+		rec.Ip = request_info.ClientIP(r)
+		rec.UserAgent = r.UserAgent()
+		rec.LastSeenAt = now
+
+		return s.db.Update("sessions", rec, rec.FileId)
+	}
+
+	// The session had a record when the request came in and has lost it since,
+	// because it was revoked or expired.  (Renew clears the ID, so logging in
+	// doesn't come this way.)  Recreating it would undo the revocation, so a
+	// fresh session is issued without anybody logged in to it.
+	if session.ID != "" {
+		for _, k := range []string{"user", "pending_user", "pending_user_at"} {
+			delete(values, k)
+			delete(session.Values, k)
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	rec = &models.Session{TokenHash: hashToken(token), UserId: values["user"], Values: values,
+		Ip: request_info.ClientIP(r), UserAgent: r.UserAgent(), CreatedAt: now, LastSeenAt: now}
+
+	_, err = s.db.Create("sessions", rec)
+	if err != nil {
+		return err
+	}
+
+	session.ID = token
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), token, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+
+	return nil
+}
+
+// Renew throws away the stored session so that the next Save issues a fresh
+// token.  Call it whenever a session changes hands (logging in) so a token
+// planted before login is worthless afterwards.
+func (s *Store) Renew(session *sessions.Session) {
+	rec, err := s.find(session.ID)
+	if err == nil {
+		s.db.Delete("sessions", rec.FileId)
+	}
+
+	session.ID = ""
+}
+
+func (s *Store) IsCurrent(session *sessions.Session, rec *models.Session) bool {
+	return session.ID != "" && hashToken(session.ID) == rec.TokenHash
+}
+
+// UserSessions returns the live sessions logged in as userId, most recently
+// used first.
+func (s *Store) UserSessions(userId string) ([]*models.Session, error) {
+	var recs []*models.Session
+
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, rec := range all {
+		if rec.UserId == userId && !s.expired(rec, now) {
+			recs = append(recs, rec)
+		}
+	}
+
+	sort.Slice(recs, func(i, j int) bool { return recs[i].LastSeenAt.After(recs[j].LastSeenAt) })
+
+	return recs, nil
+}
+
+// RevokeUser deletes every session logged in as userId except the one whose
+// ID is keepId (pass "" to revoke them all).
+func (s *Store) RevokeUser(userId string, keepId string) error {
+	all, err := s.all()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range all {
+		if rec.UserId != userId || (keepId != "" && rec.TokenHash == hashToken(keepId)) {
+			continue
+		}
+
+		err = s.db.Delete("sessions", rec.FileId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Revoke(fileId string) error {
+	return s.db.Delete("sessions", fileId)
+}
+
+func (s *Store) DeleteExpired() error {
+	all, err := s.all()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, rec := range all {
+		if !s.expired(rec, now) {
+			continue
+		}
+
+		err = s.db.Delete("sessions", rec.FileId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func (s *Store) expired(rec *models.Session, now time.Time) bool {
+	return now.Sub(rec.LastSeenAt) > s.IdleTimeout || now.Sub(rec.CreatedAt) > s.AbsoluteTimeout
+}
+
+func (s *Store) find(token string) (*models.Session, error) {
+	var rec models.Session
+
+	if token == "" {
+		return nil, errNotFound
+	}
+
+	id, err := s.db.FindFirstIdForField("sessions", "tokenhash", hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		return nil, errNotFound
+	}
+
+	err = s.db.Find("sessions", &rec, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func (s *Store) all() ([]*models.Session, error) {
+	var recs []*models.Session
+
+	ids, err := s.db.FindAllIds("sessions")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		rec := models.Session{}
+
+		err = s.db.Find("sessions", &rec, id)
+		if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, &rec)
+	}
+
+	return recs, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+package session_store
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	dir := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(dir, "sessions"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return New(db, time.Hour, 24*time.Hour, securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+}
+
+func TestSaveDoesNotResurrectARevokedSession(t *testing.T) {
+	s := newTestStore(t)
+
+	// Log in.
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	session, _ := s.New(r, "pythia")
+	session.Values["user"] = "7"
+
+	err := s.Save(r, w, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := w.Result().Cookies()[0]
+
+	// A request starts with the session, then it is revoked from elsewhere
+	// before the request saves it.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+
+	session, _ = s.New(r, "pythia")
+	if session.Values["user"] != "7" {
+		t.Fatalf("session user = %v, want 7", session.Values["user"])
+	}
+
+	err = s.RevokeUser("7", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session.Values["votes"] = "12"
+
+	err = s.Save(r, httptest.NewRecorder(), session)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := s.UserSessions("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 0 {
+		t.Errorf("user 7 has %v sessions after revocation, want none", len(sessions))
+	}
+
+	if _, ok := session.Values["user"]; ok {
+		t.Error("saved session still logged in")
+	}
+
+	if session.Values["votes"] != "12" {
+		t.Error("saved session lost its other values")
+	}
+}
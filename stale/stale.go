@@ -0,0 +1,155 @@
+package stale
+
+import (
+	"fmt"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracker keeps the list of answers that are overdue for checking.  Refresh
+// is run in the background; Overdue re-reads each answer so ones that have
+// been checked since drop off straight away.
+type Tracker struct {
+	mu              sync.Mutex
+	db              *ivy.DB
+	DefaultInterval time.Duration
+	overdueIds      []string
+	refreshedAt     time.Time
+}
+
+func New(db *ivy.DB, defaultInterval time.Duration) *Tracker {
+	return &Tracker{db: db, DefaultInterval: defaultInterval}
+}
+
+// Refresh looks through every answer for the overdue ones.
+func (t *Tracker) Refresh() error {
+	var ids []string
+
+	allIds, err := t.db.FindAllIds("answers")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, id := range allIds {
+		answer := models.Answer{}
+
+		err = t.db.Find("answers", &answer, id)
+		if err != nil {
+			return err
+		}
+
+		if answer.Overdue(now, t.DefaultInterval) {
+			ids = append(ids, id)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.overdueIds = ids
+	t.refreshedAt = now
+
+	return nil
+}
+
+// Overdue returns the answers found overdue by the last refresh that still
+// are, longest overdue first.  Answers purged from the trash since then are
+// left out.
+func (t *Tracker) Overdue() ([]*models.Answer, error) {
+	var answers []*models.Answer
+
+	t.mu.Lock()
+	ids := t.overdueIds
+	t.mu.Unlock()
+
+	allIds, err := t.db.FindAllIds("answers")
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(allIds))
+	for _, id := range allIds {
+		exists[id] = true
+	}
+
+	now := time.Now()
+
+	for _, id := range ids {
+		answer := models.Answer{}
+
+		if !exists[id] {
+			continue
+		}
+
+		err := t.db.Find("answers", &answer, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if answer.Overdue(now, t.DefaultInterval) {
+			answers = append(answers, &answer)
+		}
+	}
+
+	sort.Slice(answers, func(i, j int) bool {
+		return answers[i].VerifyDue(t.DefaultInterval).Before(answers[j].VerifyDue(t.DefaultInterval))
+	})
+
+	return answers, nil
+}
+
+func (t *Tracker) RefreshedAt() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.refreshedAt
+}
+
+// LoadDigestSent reads when the digest last went out from the file at path,
+// so that a restart on a Monday doesn't send it again.  It is the zero time
+// if the digest has never gone out.
+func LoadDigestSent(path string) (time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+}
+
+// SaveDigestSent records in the file at path that the digest went out at
+// sent.
+func SaveDigestSent(path string, sent time.Time) error {
+	return ioutil.WriteFile(path, []byte(sent.Format(time.RFC3339)+"\n"), 0600)
+}
+
+// Digest is a plain text summary of the overdue answers.
+func (t *Tracker) Digest() (string, int, error) {
+	answers, err := t.Overdue()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%v answers are overdue for checking:\n\n", len(answers))
+
+	for _, answer := range answers {
+		question := strings.SplitN(strings.TrimSpace(answer.Question), "\n", 2)[0]
+
+		fmt.Fprintf(&b, "- %v (last checked %v)\n", question, answer.LastVerified().Format("2006-01-02"))
+	}
+
+	return b.String(), len(answers), nil
+}
@@ -0,0 +1,87 @@
+package stale
+
+import (
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *ivy.DB {
+	dir := t.TempDir()
+
+	for _, name := range []string{"answers", "users"} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func TestOverdueSkipsPurgedAnswers(t *testing.T) {
+	db := newTestDB(t)
+	tracker := New(db, 24*time.Hour)
+
+	var ids []string
+
+	for _, question := range []string{"Kept", "Purged"} {
+		id, err := db.Create("answers", models.Answer{Question: question, Status: models.StatusPublished,
+			UpdatedAt: time.Now().Add(-48 * time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	err := tracker.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Delete("answers", ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answers, err := tracker.Overdue()
+	if err != nil {
+		t.Fatalf("Overdue: %v", err)
+	}
+
+	if len(answers) != 1 || answers[0].Question != "Kept" {
+		t.Errorf("Overdue = %v answers, want just the kept one", len(answers))
+	}
+}
+
+func TestDigestSent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "digest_sent")
+
+	sent, err := LoadDigestSent(path)
+	if err != nil || !sent.IsZero() {
+		t.Fatalf("before the first digest got %v, %v", sent, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+
+	err = SaveDigestSent(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent, err = LoadDigestSent(path)
+	if err != nil || !sent.Equal(now) {
+		t.Errorf("got %v, %v, want %v", sent, err, now)
+	}
+}
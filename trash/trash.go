@@ -0,0 +1,172 @@
+package trash
+
+import (
+	"errors"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"sort"
+	"time"
+)
+
+// Collections lists the collections whose records go to the trash.
+var Collections = []string{"answers", "users", "comments"}
+
+var errNotTrashable = errors.New("collection does not support the trash")
+
+type trashable interface {
+	TrashInfo() *models.Trash
+}
+
+type Item struct {
+	Collection  string
+	FileId      string
+	Title       string
+	DeletedAt   time.Time
+	DeletedById string
+	DeletedBy   string
+}
+
+// Items returns everything in the trash, most recently deleted first.
+func Items(db *ivy.DB) ([]Item, error) {
+	var items []Item
+
+	for _, collection := range Collections {
+		ids, err := db.FindAllIds(collection)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			rec, err := find(db, collection, id)
+			if err != nil {
+				return nil, err
+			}
+
+			info := rec.TrashInfo()
+			if !info.IsDeleted() {
+				continue
+			}
+
+			items = append(items, Item{Collection: collection, FileId: id, Title: title(rec), DeletedAt: info.DeletedAt,
+				DeletedById: info.DeletedById, DeletedBy: userName(db, info.DeletedById)})
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+
+	return items, nil
+}
+
+// Restore takes a record out of the trash and returns it.
+func Restore(db *ivy.DB, collection string, fileId string) (interface{}, error) {
+	rec, err := find(db, collection, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	rec.TrashInfo().Restore()
+
+	err = db.Update(collection, rec, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Purge deletes a record in the trash for good and returns what it was.
+func Purge(db *ivy.DB, collection string, fileId string) (interface{}, error) {
+	rec, err := find(db, collection, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rec.TrashInfo().IsDeleted() {
+		return nil, errors.New("only records in the trash can be purged")
+	}
+
+	err = db.Delete(collection, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// PurgeExpired purges everything that has been in the trash for longer than
+// retention and returns what it purged.
+func PurgeExpired(db *ivy.DB, retention time.Duration) ([]Item, error) {
+	var purged []Item
+
+	items, err := Items(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if time.Since(item.DeletedAt) <= retention {
+			continue
+		}
+
+		_, err = Purge(db, item.Collection, item.FileId)
+		if err != nil {
+			return purged, err
+		}
+
+		purged = append(purged, item)
+	}
+
+	return purged, nil
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func find(db *ivy.DB, collection string, fileId string) (trashable, error) {
+	var rec trashable
+
+	switch collection {
+	case "answers":
+		rec = &models.Answer{}
+	case "users":
+		rec = &models.User{}
+	case "comments":
+		rec = &models.Comment{}
+	default:
+		return nil, errNotTrashable
+	}
+
+	err := db.Find(collection, rec, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func title(rec trashable) string {
+	switch v := rec.(type) {
+	case *models.Answer:
+		return v.Question
+	case *models.User:
+		return v.Name + " (" + v.Login + ")"
+	case *models.Comment:
+		if body := []rune(v.Body); len(body) > 80 {
+			return string(body[:80]) + "..."
+		}
+
+		return v.Body
+	}
+
+	return ""
+}
+
+func userName(db *ivy.DB, userId string) string {
+	var user models.User
+
+	if userId == "" || db.Find("users", &user, userId) != nil {
+		return ""
+	}
+
+	return user.Name
+}
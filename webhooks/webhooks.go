@@ -0,0 +1,315 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A delivery is tried up to maxAttempts times, waiting twice as long after
+// each failure, starting at firstRetry (so about four hours in all).
+const (
+	maxAttempts    = 8
+	firstRetry     = 2 * time.Minute
+	keepDeliveries = 30 * 24 * time.Hour
+	pollInterval   = 30 * time.Second
+)
+
+// Dispatcher queues deliveries in the "webhook_deliveries" collection, so that
+// they survive a restart, and sends them from Run.
+type Dispatcher struct {
+	db     *ivy.DB
+	client *http.Client
+	wake   chan struct{}
+}
+
+// Payload is the JSON body sent to a webhook.  Events fire for answers in
+// every status, drafts and answers waiting for review included, so Status
+// says which one an answer is in; receivers that only want what the public
+// can see should check it is "published".
+type Payload struct {
+	Event      string      `json:"event"`
+	Id         string      `json:"id"`
+	OccurredAt time.Time   `json:"occurredat"`
+	Status     string      `json:"status,omitempty"`
+	Data       interface{} `json:"data"`
+}
+
+// Records that hold secrets are sent as their audit snapshot.
+type snapshotter interface {
+	AuditSnapshot() interface{}
+}
+
+func New(db *ivy.DB) *Dispatcher {
+	return &Dispatcher{db: db, client: &http.Client{Timeout: 10 * time.Second}, wake: make(chan struct{}, 1)}
+}
+
+// Fire queues a delivery of event, about the record rec with the given id, to
+// every active webhook subscribed to it.  Failures are printed rather than
+// returned so that a broken webhook never stops people from using the site.
+// A nil Dispatcher fires nothing.
+func (d *Dispatcher) Fire(event string, id string, rec interface{}) {
+	if d == nil {
+		return
+	}
+
+	webhooks, err := models.AllWebhooks(d.db)
+	if err != nil {
+		slog.Error("Could not look up webhooks", "err", err)
+		return
+	}
+
+	payload := Payload{Event: event, Id: id, OccurredAt: time.Now(), Data: rec}
+
+	switch answer := rec.(type) {
+	case models.Answer:
+		payload.Status = answer.Status
+	case *models.Answer:
+		payload.Status = answer.Status
+	}
+
+	if s, ok := rec.(snapshotter); ok {
+		payload.Data = s.AuditSnapshot()
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Could not build webhook payload", "err", err)
+		return
+	}
+
+	queued := false
+
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event) {
+			continue
+		}
+
+		delivery := models.WebhookDelivery{WebhookId: webhook.FileId, Url: webhook.Url, Event: event,
+			Payload: string(body), Status: models.DeliveryPending, NextAttemptAt: time.Now(), CreatedAt: time.Now()}
+
+		_, err = d.db.Create("webhook_deliveries", delivery)
+		if err != nil {
+			slog.Error("Could not queue webhook delivery", "err", err)
+			continue
+		}
+
+		queued = true
+	}
+
+	if queued {
+		d.kick()
+	}
+}
+
+// Redeliver queues a fresh copy of an earlier delivery and returns its id.
+func (d *Dispatcher) Redeliver(deliveryId string) (string, error) {
+	var old models.WebhookDelivery
+
+	err := d.db.Find("webhook_deliveries", &old, deliveryId)
+	if err != nil {
+		return "", err
+	}
+
+	delivery := models.WebhookDelivery{WebhookId: old.WebhookId, Url: old.Url, Event: old.Event, Payload: old.Payload,
+		Status: models.DeliveryPending, NextAttemptAt: time.Now(), CreatedAt: time.Now()}
+
+	fileId, err := d.db.Create("webhook_deliveries", delivery)
+	if err != nil {
+		return "", err
+	}
+
+	d.kick()
+
+	return fileId, nil
+}
+
+// Run sends deliveries as they fall due until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := d.sendDue()
+		if err != nil {
+			slog.Error("Could not send webhook deliveries", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Sign returns the value of the X-Pythia-Signature header for body sent at
+// timestamp, the value of the X-Pythia-Timestamp header.  The timestamp is
+// signed along with the body so that receivers can turn away old deliveries
+// replayed by somebody who captured them.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//=============================================================================
+// Helper Functions
+//=============================================================================
+func (d *Dispatcher) kick() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sendDue sends the deliveries that are due.  Each webhook gets its own
+// goroutine, so that one slow or unreachable endpoint doesn't hold up the
+// others; a webhook's own deliveries are still sent one at a time, in order.
+func (d *Dispatcher) sendDue() error {
+	ids, err := d.db.FindAllIds("webhook_deliveries")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	due := make(map[string][]*models.WebhookDelivery)
+
+	for _, id := range ids {
+		delivery := models.WebhookDelivery{}
+
+		err = d.db.Find("webhook_deliveries", &delivery, id)
+		if err != nil {
+			return err
+		}
+
+		if delivery.Status != models.DeliveryPending {
+			if now.Sub(delivery.CreatedAt) > keepDeliveries {
+				err = d.db.Delete("webhook_deliveries", id)
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if delivery.NextAttemptAt.After(now) {
+			continue
+		}
+
+		due[delivery.WebhookId] = append(due[delivery.WebhookId], &delivery)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for _, deliveries := range due {
+		wg.Add(1)
+
+		go func(deliveries []*models.WebhookDelivery) {
+			defer wg.Done()
+
+			for _, delivery := range deliveries {
+				d.attempt(delivery)
+
+				err := d.db.Update("webhook_deliveries", *delivery, delivery.FileId)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+
+					return
+				}
+			}
+		}(deliveries)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// attempt posts delivery to its webhook once and records how it went.
+func (d *Dispatcher) attempt(delivery *models.WebhookDelivery) {
+	var webhook models.Webhook
+
+	delivery.Attempts++
+
+	err := d.db.Find("webhooks", &webhook, delivery.WebhookId)
+	if err != nil {
+		delivery.Status = models.DeliveryFailed
+		delivery.LastError = "the webhook has been removed"
+		return
+	}
+
+	delivery.Url = webhook.Url
+
+	statusCode, err := d.post(&webhook, delivery)
+
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+
+	if err == nil && statusCode >= 200 && statusCode < 300 {
+		delivery.Status = models.DeliveryDelivered
+		delivery.DeliveredAt = time.Now()
+		return
+	}
+
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+
+	if delivery.Attempts >= maxAttempts {
+		delivery.Status = models.DeliveryFailed
+		return
+	}
+
+	delivery.NextAttemptAt = time.Now().Add(firstRetry << uint(delivery.Attempts-1))
+}
+
+func (d *Dispatcher) post(webhook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Pythia-Webhook")
+	req.Header.Set("X-Pythia-Event", delivery.Event)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("X-Pythia-Delivery", delivery.FileId)
+	req.Header.Set("X-Pythia-Timestamp", timestamp)
+	req.Header.Set("X-Pythia-Signature", Sign(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	return resp.StatusCode, nil
+}
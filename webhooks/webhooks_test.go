@@ -0,0 +1,154 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"github.com/jameycribbs/ivy"
+	"github.com/jameycribbs/pythia/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *ivy.DB {
+	dir := t.TempDir()
+
+	for _, name := range []string{"webhooks", "webhook_deliveries"} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := ivy.OpenDB(dir, models.FieldsToIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(db.Close)
+
+	return db
+}
+
+func addWebhook(t *testing.T, db *ivy.DB, url string) {
+	_, err := db.Create("webhooks", models.Webhook{Url: url, Events: []string{"answer.updated"}, Secret: "secret",
+		Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliveriesAreSignedWithATimestamp(t *testing.T) {
+	db := newTestDB(t)
+	received := make(chan Payload, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Pythia-Timestamp")
+
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+			t.Errorf("bad timestamp %q", timestamp)
+		}
+
+		if r.Header.Get("X-Pythia-Signature") != Sign("secret", timestamp, body) {
+			t.Error("signature doesn't cover the timestamp and body")
+		}
+
+		if r.Header.Get("X-Pythia-Signature") == Sign("secret", strconv.FormatInt(sent-600, 10), body) {
+			t.Error("signature would also fit an older timestamp")
+		}
+
+		var payload Payload
+
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			t.Error(err)
+		}
+
+		received <- payload
+	}))
+	defer server.Close()
+
+	addWebhook(t, db, server.URL)
+
+	d := New(db)
+	d.Fire("answer.updated", "12", models.Answer{Question: "Draft", Status: models.StatusDraft})
+
+	err := d.sendDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := <-received
+
+	if payload.Event != "answer.updated" || payload.Id != "12" || payload.Status != models.StatusDraft {
+		t.Errorf("got payload %+v", payload)
+	}
+}
+
+func TestSlowWebhookDoesNotHoldUpOthers(t *testing.T) {
+	db := newTestDB(t)
+	release := make(chan struct{})
+	fastDone := make(chan struct{})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastDone)
+	}))
+	defer fast.Close()
+
+	addWebhook(t, db, slow.URL)
+	addWebhook(t, db, fast.URL)
+
+	d := New(db)
+	d.Fire("answer.updated", "12", models.Answer{Status: models.StatusPublished})
+
+	sent := make(chan error)
+	go func() { sent <- d.sendDue() }()
+
+	select {
+	case <-fastDone:
+	case <-time.After(5 * time.Second):
+		t.Error("fast webhook waited on the slow one")
+	}
+
+	close(release)
+
+	err := <-sent
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := db.FindAllIds("webhook_deliveries")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		delivery := models.WebhookDelivery{}
+
+		err = db.Find("webhook_deliveries", &delivery, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if delivery.Status != models.DeliveryDelivered {
+			t.Errorf("delivery to %v is %v", delivery.Url, delivery.Status)
+		}
+	}
+}
+
+func TestNilDispatcherFiresNothing(t *testing.T) {
+	var d *Dispatcher
+
+	d.Fire("user.created", "1", models.User{})
+}